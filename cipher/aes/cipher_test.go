@@ -1,6 +1,7 @@
 package aes
 
 import (
+	"crypto/sha256"
 	"github.com/dedis/crypto/test"
 	"testing"
 )
@@ -8,3 +9,19 @@ import (
 func TestAES(t *testing.T) {
 	test.BlockCipherTest(t, NewCipher128)
 }
+
+func BenchmarkAES128Hash(b *testing.B) {
+	test.CipherHashBench(b, NewCipher128)
+}
+
+func BenchmarkSHA256Hash(b *testing.B) {
+	test.HashBench(b, sha256.New)
+}
+
+func TestAESLargeStream(t *testing.T) {
+	size := int64(1<<26 + 1)
+	if testing.Short() {
+		size = 1<<20 + 1
+	}
+	test.LargeStreamTest(t, NewCipher128, size)
+}
@@ -0,0 +1,20 @@
+package cipher
+
+import (
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/subtle"
+)
+
+// Check a received MAC against the one Cipher c computes
+// from its current state, after the caller has decrypted
+// and absorbed the ciphertext, e.g., via c.Message(msg, ctx, ctx).
+// This performs the verification sequence described
+// in the abstract.Cipher documentation:
+// it XORs the recomputed MAC onto a copy of the received one
+// and checks in constant time that the result is all zero.
+// The received slice is left unmodified, and the state of c is advanced.
+func CheckMAC(c abstract.Cipher, received []byte) bool {
+	mac := make([]byte, len(received))
+	c.Message(mac, received, nil)
+	return subtle.ConstantTimeAllEq(mac, 0) == 1
+}
@@ -0,0 +1,39 @@
+package cipher_test
+
+import (
+	"github.com/dedis/crypto/cipher"
+	"github.com/dedis/crypto/cipher/aes"
+	"github.com/dedis/crypto/random"
+	"testing"
+)
+
+func TestCheckMAC(t *testing.T) {
+	key := random.Bytes(16, random.Stream)
+	msg := []byte("authenticated message")
+	ctx := encrypt(key, msg)
+	ctlen := len(msg)
+	received := append([]byte{}, ctx[ctlen:]...)
+
+	check := func(ctx, mac []byte) bool {
+		c := aes.NewCipher128(key)
+		dec := make([]byte, ctlen)
+		c.Message(dec, ctx[:ctlen], ctx[:ctlen])
+		return cipher.CheckMAC(c, mac)
+	}
+	if !check(ctx, ctx[ctlen:]) {
+		t.Fatal("valid MAC rejected")
+	}
+	for i := range received {
+		if received[i] != ctx[ctlen+i] {
+			t.Fatal("CheckMAC modified the received MAC")
+		}
+	}
+
+	for i := 0; i < len(ctx); i++ {
+		bad := append([]byte{}, ctx...)
+		bad[i] ^= 1
+		if check(bad, bad[ctlen:]) {
+			t.Fatalf("MAC check passed with byte %d tampered", i)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package cipher
+
+import (
+	"errors"
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/ints"
+	"github.com/dedis/crypto/subtle"
+	"io"
+	"log"
+)
+
+// ErrBadMAC is returned by a decrypting Reader
+// when the message authenticator at the end of the stream doesn't verify.
+var ErrBadMAC = errors.New("message authentication failed")
+
+// Wrapper to decrypt and verify a stream produced by a message Cipher
+type cipherReader struct {
+	c   abstract.Cipher
+	r   io.Reader
+	buf []byte // read-ahead buffer holding back the trailing MAC
+	n   int    // number of valid bytes in buf
+	mac int    // length of the trailing MAC
+	err error  // sticky error once the stream is finished
+	inp bool   // decrypt in the caller's buffer
+}
+
+// DecryptInPlace is an Option to NewReader that, if true,
+// makes the Reader read ciphertext directly into the caller's buffer
+// and decrypt it there, rather than via an internal read-ahead buffer.
+// This lets large reads proceed in one underlying Read
+// instead of in internal-buffer-sized pieces.
+// Since the Cipher must absorb the ciphertext after decrypting it,
+// each piece is still staged through a small internal buffer,
+// so a true zero-copy decryption is not possible.
+//
+// The caller's buffer must not alias any memory
+// the underlying io.Reader still depends on,
+// and its contents beyond the returned count are undefined after a Read,
+// since the Reader also uses it to receive the withheld MAC bytes.
+// Buffers no larger than the MAC fall back to the internal buffer.
+type DecryptInPlace bool
+
+// Wrap an abstract message Cipher and an underlying io.Reader
+// to decrypt a stream encrypted in the standard fashion, i.e.,
+// a ciphertext produced by cipher.Message(ctx, msg, ctx)
+// followed by a HashSize()-byte MAC produced by cipher.Message(mac, nil, nil).
+//
+// The returned Reader yields the decrypted plaintext,
+// withholding the trailing MAC from the caller.
+// Verification of the MAC is mandatory:
+// once the underlying stream is exhausted the Reader checks the MAC,
+// and returns io.EOF only if it verifies, or ErrBadMAC otherwise.
+// A stream too short to contain a MAC also yields ErrBadMAC.
+//
+// Since the MAC covers the entire message and only arrives at its end,
+// a tampered stream cannot be detected before it has been read completely.
+// Plaintext returned before the final Read is therefore unauthenticated,
+// and callers must not act on it until the Reader has returned io.EOF.
+//
+// The only option currently supported is DecryptInPlace.
+func NewReader(c abstract.Cipher, r io.Reader,
+	options ...interface{}) io.Reader {
+	cr := &cipherReader{}
+	cr.c = c
+	cr.r = r
+	cr.mac = c.HashSize()
+	cr.buf = make([]byte, cr.mac+bufLen)
+	for _, opt := range options {
+		switch v := opt.(type) {
+		case DecryptInPlace:
+			cr.inp = bool(v)
+		default:
+			log.Panicf("Unsupported option %v", opt)
+		}
+	}
+	return cr
+}
+
+func (cr *cipherReader) Read(p []byte) (int, error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	if cr.inp && cr.n <= cr.mac && len(p) > cr.mac {
+		return cr.readInPlace(p)
+	}
+
+	// Read ahead until we have more than a MAC's worth of data buffered,
+	// so that we never decrypt what might be part of the MAC.
+	var err error
+	for cr.n <= cr.mac && err == nil {
+		var n int
+		n, err = cr.r.Read(cr.buf[cr.n:])
+		cr.n += n
+	}
+
+	if cr.n > cr.mac {
+		n := cr.n - cr.mac
+		if n > len(p) {
+			n = len(p)
+		}
+		ctx := cr.buf[:n]
+		cr.c.Partial(p[:n], ctx, ctx)
+		copy(cr.buf, cr.buf[n:cr.n])
+		cr.n -= n
+		return n, nil
+	}
+	if err != io.EOF {
+		return 0, err
+	}
+	return cr.finish()
+}
+
+// Read ciphertext directly into p, following any withheld bytes,
+// then decrypt all but the last MAC's worth of it in place.
+func (cr *cipherReader) readInPlace(p []byte) (int, error) {
+	t := copy(p, cr.buf[:cr.n])
+	var err error
+	for t <= cr.mac && err == nil {
+		var n int
+		n, err = cr.r.Read(p[t:])
+		t += n
+	}
+
+	if t > cr.mac {
+		n := t - cr.mac
+		cr.n = copy(cr.buf, p[n:t])
+
+		// The Cipher absorbs its key input after producing its output,
+		// so stage each chunk of ciphertext in the spare part of buf.
+		ctx := cr.buf[cr.mac:]
+		for i := 0; i < n; i += len(ctx) {
+			c := p[i:ints.Min(n, i+len(ctx))]
+			copy(ctx, c)
+			cr.c.Partial(c, c, ctx[:len(c)])
+		}
+		return n, nil
+	}
+	cr.n = copy(cr.buf, p[:t])
+	if err != io.EOF {
+		return 0, err
+	}
+	return cr.finish()
+}
+
+// At the end of the stream, check that whatever remains is a valid MAC.
+func (cr *cipherReader) finish() (int, error) {
+	cr.err = ErrBadMAC
+	if cr.n == cr.mac {
+		mac := cr.buf[:cr.mac]
+		cr.c.Message(nil, nil, nil)
+		cr.c.Message(mac, mac, nil)
+		if subtle.ConstantTimeAllEq(mac, 0) == 1 {
+			cr.err = io.EOF
+		}
+	}
+	return 0, cr.err
+}
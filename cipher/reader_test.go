@@ -0,0 +1,118 @@
+package cipher_test
+
+import (
+	"bytes"
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/cipher"
+	"github.com/dedis/crypto/cipher/aes"
+	"github.com/dedis/crypto/random"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// Encrypt msg in the standard fashion, appending the MAC.
+func encrypt(key, msg []byte) []byte {
+	c := aes.NewCipher128(key)
+	ctx := make([]byte, len(msg)+c.HashSize())
+	c.Message(ctx[:len(msg)], msg, ctx[:len(msg)])
+	c.Message(ctx[len(msg):], nil, nil)
+	return ctx
+}
+
+func decrypt(key, ctx []byte) ([]byte, error) {
+	r := cipher.NewReader(aes.NewCipher128(key), bytes.NewReader(ctx))
+	return ioutil.ReadAll(r)
+}
+
+func TestReader(t *testing.T) {
+	key := random.Bytes(16, random.Stream)
+	for _, l := range []int{0, 1, 1000, 100000} {
+		msg := random.Bytes(l, random.Stream)
+		ctx := encrypt(key, msg)
+
+		dec, err := decrypt(key, ctx)
+		if err != nil {
+			t.Fatalf("%d-byte stream: %v", l, err)
+		}
+		if !bytes.Equal(dec, msg) {
+			t.Fatalf("%d-byte stream decrypted incorrectly", l)
+		}
+
+		// Any corruption must be caught by the final MAC check.
+		for _, i := range []int{0, len(ctx) / 2, len(ctx) - 1} {
+			bad := append([]byte{}, ctx...)
+			bad[i] ^= 1
+			if _, err := decrypt(key, bad); err != cipher.ErrBadMAC {
+				t.Fatalf("%d-byte stream with byte %d flipped: %v",
+					l, i, err)
+			}
+		}
+		if _, err := decrypt(key, ctx[:len(ctx)-1]); err != cipher.ErrBadMAC {
+			t.Fatalf("truncated %d-byte stream: %v", l, err)
+		}
+	}
+	if _, err := decrypt(abstract.NoKey, encrypt(key, nil)); err != cipher.ErrBadMAC {
+		t.Fatalf("wrong key: %v", err)
+	}
+}
+
+// Reader yielding its data in chunks of varying sizes.
+type choppyReader struct {
+	data []byte
+	i    int
+}
+
+func (r *choppyReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	r.i++
+	n := r.i % 50 * 37
+	if n > len(p) {
+		n = len(p)
+	}
+	if n > len(r.data) {
+		n = len(r.data)
+	}
+	copy(p, r.data[:n])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestReaderInPlace(t *testing.T) {
+	key := random.Bytes(16, random.Stream)
+	msg := random.Bytes(4<<20+123, random.Stream)
+	ctx := encrypt(key, msg)
+
+	copying, err := decrypt(key, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read with buffers of varying sizes, some too small for in-place use.
+	r := cipher.NewReader(aes.NewCipher128(key), &choppyReader{data: ctx},
+		cipher.DecryptInPlace(true))
+	var inplace []byte
+	for i := 0; ; i++ {
+		buf := make([]byte, []int{1, 16, 17, 4096, 100000}[i%5])
+		n, err := r.Read(buf)
+		inplace = append(inplace, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(inplace, copying) || !bytes.Equal(inplace, msg) {
+		t.Fatal("in-place decryption differs from copying decryption")
+	}
+
+	ctx[len(ctx)/2] ^= 1
+	r = cipher.NewReader(aes.NewCipher128(key), bytes.NewReader(ctx),
+		cipher.DecryptInPlace(true))
+	if _, err := ioutil.ReadAll(r); err != cipher.ErrBadMAC {
+		t.Fatalf("corrupted stream decrypted in place: %v", err)
+	}
+}
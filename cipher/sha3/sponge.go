@@ -7,6 +7,7 @@ package sha3
 import (
 	//"encoding/hex"
 	"encoding/binary"
+	"errors"
 	"github.com/dedis/crypto/cipher"
 )
 
@@ -61,6 +62,26 @@ func (d *sponge) Transform(dst, src []byte) {
 	//println("->\n" + hex.Dump(odst))
 }
 
+// Serialize the sponge state.
+func (d *sponge) MarshalBinary() ([]byte, error) {
+	data := make([]byte, stateLen)
+	for i := range d.a {
+		binary.LittleEndian.PutUint64(data[i*8:], d.a[i])
+	}
+	return data, nil
+}
+
+// Restore a sponge state serialized by MarshalBinary.
+func (d *sponge) UnmarshalBinary(data []byte) error {
+	if len(data) != stateLen {
+		return errors.New("wrong size sponge state")
+	}
+	for i := range d.a {
+		d.a[i] = binary.LittleEndian.Uint64(data[i*8:])
+	}
+	return nil
+}
+
 // Create a Keccak sponge primitive with 256-bit capacity.
 func newKeccak256() cipher.Sponge { return &sponge{rate: 168} }
 
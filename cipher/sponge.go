@@ -1,6 +1,8 @@
 package cipher
 
 import (
+	"encoding"
+	"errors"
 	"fmt"
 	"log"
 	//"encoding/hex"
@@ -271,3 +273,47 @@ func (sc *spongeCipher) HashSize() int {
 func (sc *spongeCipher) BlockSize() int {
 	return sc.sponge.Rate()
 }
+
+// MarshalBinary serializes the Cipher's current state,
+// so that a Cipher created with the same constructor and options
+// can resume from it via UnmarshalBinary,
+// e.g., to continue a long stream after a process restart.
+// This works only if the underlying Sponge supports serialization.
+// The serialized state includes all secret key material.
+func (sc *spongeCipher) MarshalBinary() ([]byte, error) {
+	m, ok := sc.sponge.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, errors.New("sponge state not serializable")
+	}
+	state, err := m.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	data := append(state, sc.buf...)
+	var pos [4]byte
+	binary.BigEndian.PutUint32(pos[:], uint32(sc.pos))
+	return append(data, pos[:]...), nil
+}
+
+// UnmarshalBinary restores a Cipher state serialized by MarshalBinary.
+func (sc *spongeCipher) UnmarshalBinary(data []byte) error {
+	u, ok := sc.sponge.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return errors.New("sponge state not serializable")
+	}
+	tail := len(sc.buf) + 4
+	if len(data) < tail {
+		return errors.New("serialized cipher state too short")
+	}
+	split := len(data) - tail
+	pos := int(binary.BigEndian.Uint32(data[len(data)-4:]))
+	if pos > sc.rate {
+		return errors.New("serialized cipher state malformed")
+	}
+	if err := u.UnmarshalBinary(data[:split]); err != nil {
+		return err
+	}
+	copy(sc.buf, data[split:])
+	sc.pos = pos
+	return nil
+}
@@ -0,0 +1,99 @@
+package nego
+
+import (
+	"container/list"
+	"github.com/dedis/crypto/abstract"
+	"sync"
+)
+
+// Identifies a ciphersuite's derived point positions in the suite cache.
+type posKey struct {
+	ste     abstract.Suite
+	nlevels int
+	domain  string
+	order   string
+}
+
+// Cached point positions of a ciphersuite.
+type posEntry struct {
+	key posKey
+	tag []uint32
+	pos []int
+}
+
+// Least-recently-used cache of derived point positions,
+// shared by all Writers and safe for concurrent use.
+type suiteCache struct {
+	mu    sync.Mutex
+	size  int                      // Maximum number of entries
+	lru   list.List                // Entries, most recently used first
+	items map[posKey]*list.Element // Entries by key
+}
+
+// Cache of positions consulted by suiteInfo.init().
+var positions suiteCache
+
+// Set the maximum number of ciphersuites whose point positions
+// are cached across all Writers, evicting the least recently used
+// suites beyond that number.
+// Since positions derive deterministically from each suite,
+// eviction costs only their recomputation,
+// while the bound keeps servers that see many distinct,
+// possibly adversarial, suites from caching positions without limit.
+// Positions derived via SetPositionHash() are never cached.
+// The default size of 0 disables the cache.
+func SetSuiteCacheSize(n int) {
+	positions.mu.Lock()
+	defer positions.mu.Unlock()
+	positions.size = n
+	positions.evict()
+}
+
+// Fill in si's tags and positions from the cache, if present,
+// returning true on a hit.
+func (c *suiteCache) get(key posKey, si *suiteInfo) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el := c.items[key]
+	if el == nil {
+		return false
+	}
+	c.lru.MoveToFront(el)
+	ent := el.Value.(*posEntry)
+	copy(si.tag, ent.tag)
+	copy(si.pos, ent.pos)
+	return true
+}
+
+// Cache si's tags and positions, if the cache is enabled.
+func (c *suiteCache) put(key posKey, si *suiteInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size <= 0 || c.items[key] != nil {
+		return
+	}
+	if c.items == nil {
+		c.items = make(map[posKey]*list.Element)
+	}
+	ent := &posEntry{key, append([]uint32(nil), si.tag...),
+		append([]int(nil), si.pos...)}
+	c.items[key] = c.lru.PushFront(ent)
+	c.evict()
+}
+
+// Evict least recently used entries beyond the cache size.
+// The caller must hold c.mu.
+func (c *suiteCache) evict() {
+	for c.lru.Len() > c.size && c.lru.Len() > 0 {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.items, el.Value.(*posEntry).key)
+	}
+}
+
+// Return the number of cached suites.
+func (c *suiteCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
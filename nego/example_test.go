@@ -0,0 +1,51 @@
+package nego_test
+
+import (
+	"fmt"
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/cipher/sha3"
+	"github.com/dedis/crypto/nego"
+	"github.com/dedis/crypto/test"
+)
+
+/*
+This example illustrates how to lay out a negotiation header
+for three recipients spread across two ciphersuites.
+Mock suites are used here for speed; a real application
+would use real ciphersuites such as those in the edwards package.
+The deterministic stream makes the example's output reproducible;
+a real application should use a cryptographically random stream
+such as random.Stream.
+*/
+func Example_layout() {
+
+	// Deterministic pseudo-random stream for this example
+	rand := sha3.NewShakeCipher128([]byte("example"))
+
+	// Two ciphersuites, with 32-byte and 64-byte hiding encodings,
+	// each allowed 4 levels of alternative point positions.
+	suite1 := test.MockSuite("Mock32", 32)
+	suite2 := test.MockSuite("Mock64", 64)
+	suiteLevel := map[abstract.Suite]int{suite1: 4, suite2: 4}
+
+	// Three recipients, each with 16 bytes of entrypoint data.
+	var entrypoints []nego.Entry
+	for _, suite := range []abstract.Suite{suite1, suite1, suite2} {
+		_, pub := test.GenKeypair(suite, rand)
+		data := make([]byte, 16)
+		rand.XORKeyStream(data, data)
+		entrypoints = append(entrypoints,
+			nego.Entry{Suite: suite, PubKey: pub, Data: data})
+	}
+
+	// Lay out the header and report its total length.
+	w := nego.Writer{}
+	hdrlen, err := w.Layout(suiteLevel, entrypoints, rand)
+	if err != nil {
+		fmt.Println("layout failed:", err)
+		return
+	}
+	fmt.Println("header length:", hdrlen)
+	// Output:
+	// header length: 512
+}
@@ -0,0 +1,188 @@
+package nego
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/dedis/crypto/abstract"
+)
+
+// Provide the ciphersuites and entrypoints for which a layout was computed,
+// in preparation for restoring that layout via UnmarshalBinary().
+// The suiteLevel map and entrypoints must be the same
+// as those originally passed to Layout() to compute the layout.
+func (w *Writer) SetInputs(suiteLevel map[abstract.Suite]int,
+	entrypoints []Entry) {
+	w.simap = make(map[abstract.Suite]*suiteInfo)
+	for suite, nlevels := range w.allLevels(suiteLevel) {
+		w.simap[suite] = &suiteInfo{ste: suite, pos: make([]int, nlevels)}
+	}
+	w.suites.s = nil
+	w.entries = entrypoints
+}
+
+// Serialize the layout computed by Layout(),
+// so that another Writer may restore it via UnmarshalBinary()
+// and produce headers via Write() without recomputing the layout.
+// The serialized layout includes each ciphersuite's point positions
+// and chosen level, the header length, and the entrypoint offsets.
+// It contains no secrets: ephemeral keys are chosen afresh by Write().
+func (w *Writer) MarshalBinary() ([]byte, error) {
+	if w.simap == nil {
+		return nil, errors.New("MarshalBinary called before Layout")
+	}
+	var buf bytes.Buffer
+	put := func(v int) {
+		binary.Write(&buf, binary.BigEndian, uint32(v))
+	}
+
+	put(w.hdrlen)
+	put(len(w.suites.s))
+	for _, si := range w.suites.s {
+		name := si.ste.String()
+		put(len(name))
+		buf.WriteString(name)
+		put(si.plen)
+		put(si.lev)
+		put(len(si.pos))
+		for _, pos := range si.pos {
+			put(pos)
+		}
+	}
+	put(len(w.entries))
+	for i := range w.entries {
+		put(w.entofs[i])
+	}
+	return buf.Bytes(), nil
+}
+
+// Restore a layout serialized by MarshalBinary().
+// The ciphersuites and entrypoints the layout was computed for
+// must first be supplied via SetInputs(),
+// and the suffix length, if any, via SetSuffixLen(),
+// the entrypoint MAC length and version, if any,
+// via SetEntryMACLen() and SetEntryVersion(),
+// and the header MAC key, if any, via SetHeaderMAC().
+func (w *Writer) UnmarshalBinary(data []byte) error {
+	if w.simap == nil {
+		return errors.New("UnmarshalBinary called before SetInputs")
+	}
+	if err := w.unmarshalLayout(data); err != nil {
+		w.simap = nil
+		return err
+	}
+	return nil
+}
+
+// Largest header length UnmarshalBinary() accepts,
+// since the serialized length determines how much Write() allocates.
+const maxLayoutLen = 1 << 24
+
+func (w *Writer) unmarshalLayout(data []byte) error {
+	names := make(map[string]abstract.Suite)
+	for suite := range w.simap {
+		names[suite.String()] = suite
+	}
+
+	r := bytes.NewReader(data)
+	errBad := errors.New("malformed or mismatched layout")
+	var err error
+	get := func() int {
+		var v uint32
+		if err == nil {
+			err = binary.Read(r, binary.BigEndian, &v)
+		}
+		return int(v)
+	}
+
+	w.layout.reset()
+	w.exclude.reset()
+	w.entofs = make(map[int]int)
+	w.entlens = make([]int, len(w.entries))
+	w.decoys = nil // decoy regions just become random fill
+	w.buf = nil
+
+	w.hdrlen = get()
+	nsuites := get()
+	if err != nil || nsuites != len(w.simap) || w.hdrlen > maxLayoutLen {
+		return errBad
+	}
+	w.suites.s = make([]*suiteInfo, 0, nsuites)
+	seen := make(map[*suiteInfo]bool)
+	for i := 0; i < nsuites; i++ {
+		namelen := get()
+		if err != nil || namelen > r.Len() {
+			return errBad
+		}
+		name := make([]byte, namelen)
+		r.Read(name)
+		si := w.simap[names[string(name)]]
+		if si == nil || seen[si] {
+			return errBad
+		}
+		seen[si] = true
+		h, ok := si.ste.Point().(abstract.Hiding)
+		si.plen = get()
+		si.lev = get()
+		if !ok || si.plen != h.HideLen() {
+			return errBad
+		}
+		if get() != len(si.pos) || si.lev >= len(si.pos) {
+			return errBad
+		}
+
+		// Positions must increase without overlapping, as derived,
+		// but may extend past the header, except the primary one.
+		for j := range si.pos {
+			si.pos[j] = get()
+			if j > 0 && si.pos[j] < si.pos[j-1]+si.plen {
+				return errBad
+			}
+			lo, hi := si.region(j)
+			w.exclude.reserve(lo, hi, false, si.String())
+		}
+		if err != nil {
+			return errBad
+		}
+		si.max = si.pos[len(si.pos)-1] + si.plen
+		lo, hi := si.region(si.lev)
+		if hi > w.hdrlen || !w.layout.reserve(lo, hi, true, si.String()) {
+			return errBad
+		}
+		w.suites.s = append(w.suites.s, si)
+	}
+
+	if get() != len(w.entries) {
+		return errBad
+	}
+	for i := range w.entries {
+		e := &w.entries[i]
+		lo := get()
+		l := len(w.entryData(e))
+		hi := lo + l
+		if l > 0 {
+			hi += w.entryOverhead()
+		}
+		if err != nil || w.simap[e.Suite] == nil || hi > w.hdrlen {
+			return errBad
+		}
+		if hi > lo && !w.layout.reserve(lo, hi, true, e.String()) {
+			return errBad
+		}
+		w.entofs[i] = lo
+		w.entlens[i] = l
+	}
+	end := w.hdrlen - w.macLen()
+	if l := w.macLen(); l > 0 && (end < 0 ||
+		!w.layout.reserve(end, w.hdrlen, true, "mac")) {
+		return errBad
+	}
+	if l := len(w.suffix); l > 0 && (l > end ||
+		!w.layout.reserve(end-l, end, true, "suffix")) {
+		return errBad
+	}
+	if r.Len() != 0 {
+		return errBad
+	}
+	return nil
+}
@@ -6,25 +6,67 @@ package nego
 -	add SetSizeLimit() method to allow clients to enforce a limit
 	on the produced header size (at the risk of layout failure).
 -	incrementally expand allocation mask instead of starting at worst-case
+-	the Reader should take a fixed position table matching
+	Writer.SetSuitePositions(), and derive entrypoint positions like
+	Writer.scatterEntry() for headers laid out with SetScatterPayloads(),
+	rather than trying every offset.
+-	Reader.ReadAll serves recipients holding several entrypoints
+	in one header, which Layout() should only allow once it can do so
+	safely (see the XXX on Layout()).
+-	Reader.ReadAt should read only the candidate entrypoint bytes
+	once entrypoint positions are derived rather than probed.
 */
 
 import (
 	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/random"
+	"io"
 	"sort"
 )
 
+// Maximum length of an entrypoint's data.
+// Entrypoints hold keys and pointers to the real content, not content itself,
+// so this bound only guards against bad or untrusted inputs.
+const maxEntryLen = 1 << 16
+
+// Length of the optional MAC over the whole header; see SetHeaderMAC().
+const HeaderMACLen = sha256.Size
+
+// Recommended length of per-entrypoint MACs; see SetEntryMACLen().
+const DefaultEntryMACLen = 16
+
 type Entry struct {
 	Suite  abstract.Suite // Ciphersuite this public key is drawn from
 	PubKey abstract.Point // Public key of this entrypoint's owner
 	Data   []byte         // Entrypoint data decryptable by owner
 }
 
-func (e *Entry) String() string {
-	return fmt.Sprintf("(%s)%p", e.Suite, e)
+// Describe an entrypoint for logging and error messages
+// by its suite, a short fingerprint of its owner's public key,
+// and the length of its data, but never the data itself.
+func (e Entry) String() string {
+	fp := "nil"
+	if e.PubKey != nil {
+		buf, _ := e.PubKey.MarshalBinary()
+		if len(buf) > 4 {
+			buf = buf[:4]
+		}
+		fp = fmt.Sprintf("%x", buf)
+	}
+	return fmt.Sprintf("(%s)%s[%d bytes]", e.Suite, fp, len(e.Data))
+}
+
+// Marshal an entrypoint's String() description as text,
+// for loggers that prefer encoding.TextMarshaler.
+func (e Entry) MarshalText() ([]byte, error) {
+	return []byte(e.String()), nil
 }
 
 // A ciphersuite used in a negotiation header.
@@ -56,26 +98,68 @@ type suiteInfo struct {
 	// layout info
 	//nodes []*node			// layout node for reserved positions
 	lev int             // layout-chosen level for this suite
-	pri abstract.Secret // ephemeral Diffie-Hellman private key
+	pri abstract.Secret // ephemeral Diffie-Hellman private key, unless wiped
 	pub []byte          // corresponding encoded public key
+	pnt abstract.Point  // corresponding public key Point
 }
 
 func (si *suiteInfo) String() string {
 	return "Suite " + si.ste.String()
 }
 
-// Determine all the alternative DH point positions for a ciphersuite.
-func (si *suiteInfo) init(ste abstract.Suite, nlevels int) {
+// Determine all the alternative DH point positions for a ciphersuite,
+// pseudo-randomly derived from the suite's name and a position domain.
+// Tags are extracted from the pseudo-random stream in the given byte order,
+// or big-endian if order is nil.
+// The stream comes from hash applied to the seed,
+// or from the suite's own Cipher keyed with the seed if hash is nil.
+// Returns an error if the suite can't be laid out at the given level.
+func (si *suiteInfo) init(ste abstract.Suite, nlevels int, domain string,
+	order binary.ByteOrder, hash func([]byte) cipher.Stream) error {
+	return si.derive(ste, nlevels, domain, order, hash, hash == nil)
+}
+
+// Determine a ciphersuite's positions as init() does,
+// consulting and filling the position cache only if cached is true.
+func (si *suiteInfo) derive(ste abstract.Suite, nlevels int, domain string,
+	order binary.ByteOrder, hash func([]byte) cipher.Stream,
+	cached bool) error {
+	if order == nil {
+		order = binary.BigEndian
+	}
+	if nlevels < 1 {
+		return errors.New("suite " + ste.String() +
+			" has a level less than 1")
+	}
+	h, ok := ste.Point().(abstract.Hiding)
+	if !ok {
+		return errors.New("suite " + ste.String() +
+			" has no hiding point encoding")
+	}
 	si.ste = ste
 	si.tag = make([]uint32, nlevels)
 	si.pos = make([]int, nlevels)
-	si.plen = ste.Point().(abstract.Hiding).HideLen() // XXX
+	si.plen = h.HideLen()
+	if si.plen < 1 {
+		return errors.New("suite " + ste.String() +
+			" has an empty hiding point encoding")
+	}
+
+	// Reuse cached positions, if any (see SetSuiteCacheSize).
+	key := posKey{ste, nlevels, domain, order.String()}
+	if cached && positions.get(key, si) {
+		si.max = si.pos[nlevels-1] + si.plen
+		return nil
+	}
 
 	// Create a pseudo-random stream from which to pick positions
-	str := fmt.Sprintf("NegoCipherSuite:%s", ste.String())
-	rand := ste.Cipher([]byte(str))
+	str := fmt.Sprintf("%sNegoCipherSuite:%s", domain, ste.String())
+	rand := positionStream(ste, []byte(str), hash)
 
 	// Alternative 0 is always at position 0, so start with level 1.
+	// Each level has its own table of alternatives following the last,
+	// so positions at different levels can never coincide,
+	// even if their tags happen to select the same index.
 	levofs := 0 // starting offset for current level
 	//fmt.Printf("Suite %s positions:\n", ste.String())
 	for i := 0; i < nlevels; i++ {
@@ -85,7 +169,7 @@ func (si *suiteInfo) init(ste abstract.Suite, nlevels int) {
 		rand.XORKeyStream(buf[:], buf[:])
 		levlen := 1 << uint(i) // # alt positions at this level
 		levmask := levlen - 1  // alternative index mask
-		si.tag[i] = binary.BigEndian.Uint32(buf[:])
+		si.tag[i] = order.Uint32(buf[:])
 		levidx := int(si.tag[i]) & levmask
 		si.pos[i] = levofs + levidx*si.plen
 
@@ -97,6 +181,33 @@ func (si *suiteInfo) init(ste abstract.Suite, nlevels int) {
 
 	// Limit of highest point field
 	si.max = si.pos[nlevels-1] + si.plen
+	if cached {
+		positions.put(key, si)
+	}
+	return nil
+}
+
+// Return the byte offsets of a ciphersuite's alternative point positions
+// at each of nlevels levels, derived exactly as Layout() derives them
+// under the default position domain, tag byte order and position hash,
+// so that other implementations can check their derivations against it.
+// Returns nil if the suite can't be laid out at the given level.
+func SuitePositions(suite abstract.Suite, nlevels int) []int {
+	var si suiteInfo
+	if err := si.init(suite, nlevels, "", nil, nil); err != nil {
+		return nil
+	}
+	return si.pos
+}
+
+// Return the pseudo-random stream for deriving positions from seed,
+// produced by hash if non-nil, or else by the suite's own Cipher.
+func positionStream(ste abstract.Suite, seed []byte,
+	hash func([]byte) cipher.Stream) cipher.Stream {
+	if hash != nil {
+		return hash(seed)
+	}
+	return ste.Cipher(seed)
 }
 
 // Return the byte-range for a point at a given level.
@@ -129,12 +240,32 @@ func (s *suiteList) Len() int {
 	return len(s.s)
 }
 func (s *suiteList) Less(i, j int) bool {
-	return s.s[i].max < s.s[j].max
+	si, sj := s.s[i], s.s[j]
+	if si.max != sj.max {
+		return si.max < sj.max
+	}
+	return si.ste.String() < sj.ste.String() // break ties deterministically
 }
 func (s *suiteList) Swap(i, j int) {
 	s.s[i], s.s[j] = s.s[j], s.s[i]
 }
 
+// ConflictEvent records that Layout found a ciphersuite's point position
+// at a given level already claimed by another ciphersuite's positions,
+// making that level unusable as the suite's primary position.
+type ConflictEvent struct {
+	Suite            abstract.Suite // Suite being laid out
+	TriedLevel       int            // Level whose position conflicted
+	ConflictingSuite abstract.Suite // Suite already claiming the position
+}
+
+// Reservation describes a byte range [Lo,Hi) claimed in a header layout,
+// and the name of its claimant, e.g., "Suite Ed25519".
+type Reservation struct {
+	Lo, Hi int    // Byte range reserved
+	Name   string // Name of the reservation's owner
+}
+
 // Writer produces a cryptographic negotiation header,
 // which conceals a variable number of "entrypoints"
 // within a variable-length binary blob of random-looking bits.
@@ -150,20 +281,535 @@ func (s *suiteList) Swap(i, j int) {
 // and encrypted with a symmetric key included in the entrypoint data,
 // which can be (but doesn't have to be) shared by many or all entrypoints.
 //
+// A Writer is not safe for concurrent use, since Write() and Payload()
+// record per-header state such as ephemeral keys in the Writer.
+// To produce several headers concurrently from one layout,
+// call Layout() once, then Clone() the Writer for each goroutine.
+//
 type Writer struct {
 	suites  suiteList                     // Sorted list of ciphersuites used
 	simap   map[abstract.Suite]*suiteInfo // suiteInfo for each Suite
 	layout  skipLayout                    // Reservation map representing layout
+	exclude skipLayout                    // All point positions of all suites
 	entries []Entry                       // Entrypoints defined by caller
 	entofs  map[int]int                   // Map of entrypoints to header offsets
+	entlens []int                         // Entrypoint data lengths laid out
+	hdrlen  int                           // Header length computed by Layout
 	maxLen  int                           // Client-specified maximum header length
+	maxEnts int                           // Client-specified maximum entrypoints
+	shared  []byte                        // Content key wrapped in all entrypoints
+	nodata  bool                          // Entrypoints carry no payload
+	fixed   []abstract.Suite              // Suites always laid out, if any
+	suffix  []byte                        // Trailer placed at end of header
+	single  bool                          // Use only level 0 positions
+	domain  string                        // Prefix for position derivation
+	clashes []ConflictEvent               // Conflicts found by Layout
+	compact bool                          // Search for a shorter layout
+	order   binary.ByteOrder              // Byte order of position tags
+	mackey  []byte                        // Key for header MAC, if any
+	align   int                           // Payload start alignment, if any
+	ndecoy  int                           // Number of decoy entrypoints
+	decoys  []int                         // Header offsets of decoys
+	declen  int                           // Length of each decoy
+	nowipe  bool                          // Keep secrets after Write
+	scatter bool                          // Derive entrypoint positions
+	poshash func([]byte) cipher.Stream    // Position stream, if not suite's
+	entmac  int                           // Length of each entrypoint MAC
+	entver  byte                          // Entrypoint format version
+	hasver  bool                          // Prepend entver to entrypoints
+	fixpos  map[abstract.Suite][]int      // Externally specified positions
+	soft    bool                          // maxLen is a target, not a limit
+	over    bool                          // Last Layout exceeded soft maxLen
+	nocache bool                          // Bypass the position cache
+	infos   []suiteInfo                   // Preallocated suiteInfo pool
 	buf     []byte                        // Buffer in which to build message
 }
 
 // Set the optional maximum length for the negotiation header,
-// affecting subsequent calls to Layout()
+// affecting subsequent calls to Layout().
+// Layout() fails if the header cannot be laid out within this length.
+// A maximum length of 0 means the header length is unlimited.
 func (w *Writer) SetMaxLen(max int) {
 	w.maxLen = max
+	w.soft = false
+}
+
+// Set a soft maximum length for the negotiation header,
+// affecting subsequent calls to Layout().
+// Like SetMaxLen(), but if the header cannot be laid out within max bytes,
+// Layout() lays it out without the limit rather than failing,
+// returning the resulting longer header length,
+// and OverMaxLen() reports that the limit was exceeded.
+// This serves protocols that prefer a slightly oversized header
+// to dropping recipients.
+func (w *Writer) SetMaxLenSoft(max int) {
+	w.maxLen = max
+	w.soft = true
+}
+
+// Report whether the last call to Layout(), or AddSuite() since,
+// exceeded the soft maximum length set by SetMaxLenSoft().
+func (w *Writer) OverMaxLen() bool {
+	return w.over
+}
+
+// Set the optional maximum number of entrypoints,
+// affecting subsequent calls to Layout(),
+// which fails without doing any work if given more entrypoints.
+// This bounds the resources a server spends laying out untrusted requests.
+// A maximum of 0 means the number of entrypoints is unlimited.
+func (w *Writer) SetMaxEntries(max int) {
+	w.maxEnts = max
+}
+
+// Set a symmetric content key to be wrapped in every entrypoint,
+// in place of the entrypoints' individual Data slices,
+// affecting subsequent calls to Layout() and Write().
+// This supports the common case in which all entrypoint owners
+// decrypt the same content located after the negotiation header.
+// Each owner recovers the key by decrypting its entrypoint as usual.
+func (w *Writer) SetSharedKey(key []byte) {
+	w.shared = key
+}
+
+// Set whether entrypoints are presence-only,
+// affecting subsequent calls to Layout() and Write().
+// Presence-only entrypoints consist of nothing but their suite's
+// ephemeral Diffie-Hellman point, and reserve no space for a payload,
+// so their Data slices must be empty.
+// Otherwise, every entrypoint must carry a non-empty payload.
+func (w *Writer) SetPresenceOnly(presence bool) {
+	w.nodata = presence
+}
+
+// Set a fixed, public set of ciphersuites to be laid out
+// by subsequent calls to Layout(), in addition to those in suiteLevel,
+// whether or not any entrypoints use them.
+// The header layout then depends only on this set
+// and not on which suites actually have recipients,
+// hiding how many recipients exist per suite.
+// Suites missing from suiteLevel get the level DefaultLevels() assigns
+// for a set of this size, so a caller should either always or never
+// include a given suite of the set in suiteLevel.
+// Passing nil disables the fixed set.
+func (w *Writer) SetFixedSuiteSet(suites []abstract.Suite) {
+	w.fixed = suites
+}
+
+// Set a domain string for deriving ciphersuites' point positions,
+// affecting subsequent calls to Layout() and AddSuite().
+// The domain prefixes the seed from which each suite's positions derive,
+// so that a new protocol version can place points differently
+// without breaking headers produced under an old one.
+// Readers must use the same domain to find the points.
+// The default empty domain yields the original positions.
+func (w *Writer) SetPositionDomain(domain string) {
+	w.domain = domain
+}
+
+// Set the byte order in which position tags are extracted
+// from each ciphersuite's pseudo-random position stream,
+// affecting subsequent calls to Layout() and AddSuite().
+// This exists for interoperability with implementations
+// that derive positions using little-endian tags.
+// Readers must use the same byte order to find the points.
+// The default is binary.BigEndian.
+func (w *Writer) SetTagEndianness(order binary.ByteOrder) {
+	w.order = order
+}
+
+// Set a suite-independent hash from which to derive
+// the pseudo-random streams that determine point and entrypoint positions,
+// affecting subsequent calls to Layout() and AddSuite().
+// By default each suite's positions derive from the suite's own Cipher,
+// so they depend on each suite's choice of symmetric primitives;
+// a fixed hash, e.g., a SHAKE-based one, makes positions depend
+// only on the position domain, the suite's name and its point length.
+// Readers must use the same hash to find the points.
+// Passing nil restores the default.
+func (w *Writer) SetPositionHash(hash func([]byte) cipher.Stream) {
+	w.poshash = hash
+}
+
+// Set a fixed table of point positions for a ciphersuite,
+// affecting subsequent calls to Layout() and AddSuite(),
+// which use the given byte offsets as the suite's alternative positions
+// in place of deriving them, e.g., to interoperate with implementations
+// whose specification publishes a position table per suite.
+// The suite then has len(positions) levels regardless of suiteLevel.
+// The positions must be non-negative and increasing,
+// each at least the suite's point length past the one before,
+// or Layout() fails. Readers must use the same table to find the point.
+// Passing nil positions restores derivation for the suite.
+func (w *Writer) SetSuitePositions(suite abstract.Suite, positions []int) {
+	fixpos := make(map[abstract.Suite][]int, len(w.fixpos)+1)
+	for s, pos := range w.fixpos {
+		fixpos[s] = pos
+	}
+	if positions == nil {
+		delete(fixpos, suite)
+	} else {
+		fixpos[suite] = append(make([]int, 0, len(positions)),
+			positions...)
+	}
+	w.fixpos = fixpos
+}
+
+// Set whether Layout() should search for a shorter header,
+// by trying alternative orders in which to lay out the ciphersuites
+// beyond the default order, which gives suites with the most restrictive
+// positioning first choice of positions.
+// This trades Layout() time for a tighter header,
+// and is deterministic given the rand stream passed to Layout().
+func (w *Writer) SetOptimize(optimize bool) {
+	w.compact = optimize
+}
+
+// Set whether to use single-level mode,
+// affecting subsequent calls to Layout().
+// In single-level mode each ciphersuite uses only level 0,
+// placing its point at the start of the header,
+// and the entrypoints are simply packed after it.
+// This makes the header layout trivially predictable,
+// for debugging and for protocols needing no negotiation among suites,
+// but it supports only one ciphersuite:
+// Layout() fails if given more than one.
+func (w *Writer) SetSingleLevel(single bool) {
+	w.single = single
+}
+
+// Set the length of an optional suffix region,
+// affecting subsequent calls to Layout() and Write().
+// Layout() reserves the suffix region at the very end of the header,
+// after all points and entrypoints, and includes it in the header length.
+// The caller fills in the slice returned by Suffix() before calling Write(),
+// which places it verbatim at the end of the header,
+// e.g., for a fixed protocol trailer.
+// A length of 0 or less means no suffix.
+func (w *Writer) SetSuffixLen(n int) {
+	if n < 0 {
+		n = 0
+	}
+	w.suffix = make([]byte, n)
+}
+
+// Set the length of a MAC following each entrypoint's encrypted data,
+// affecting subsequent calls to Layout() and Write().
+// Write() encrypts each entrypoint with its suite's Cipher
+// in authenticated mode, appending a MAC of n bytes, so that a reader
+// can check in constant time whether it has found and decrypted
+// its own entrypoint rather than random bits.
+// Each entrypoint's reserved region grows by n bytes,
+// so shorter MACs save header space but make it correspondingly easier
+// to forge an entrypoint or mistake random bits for one:
+// a forger succeeds with probability 2^(-8n) per attempt.
+// DefaultEntryMACLen is a sensible choice;
+// the default of 0 leaves entrypoints unauthenticated,
+// compatible with headers from before entrypoint MACs existed.
+// Presence-only entrypoints carry no MAC.
+func (w *Writer) SetEntryMACLen(n int) {
+	w.entmac = n
+}
+
+// Set a format version byte that Write() prepends to each entrypoint's data
+// inside the encryption, affecting subsequent calls to Layout() and Write(),
+// so that the entrypoint data format can evolve
+// while readers recognize which format they decrypted.
+// Each entrypoint's reserved region grows by one byte.
+// By default entrypoints carry no version byte.
+func (w *Writer) SetEntryVersion(version byte) {
+	w.entver = version
+	w.hasver = true
+}
+
+// Return the bytes each entrypoint occupies beyond its data:
+// the version byte and MAC, if any.
+func (w *Writer) entryOverhead() int {
+	n := w.entmac
+	if w.hasver {
+		n++
+	}
+	return n
+}
+
+// Set the number of decoy entrypoints,
+// affecting subsequent calls to Layout() and Write().
+// Layout() reserves each decoy like a real entrypoint,
+// with the length of the longest real entrypoint's data,
+// and Write() fills decoys with random bits,
+// so that an observer can't count the real entrypoints
+// by looking for entrypoint-shaped regions.
+// Decoys decrypt to garbage under any key, so readers ignore them.
+// With no entrypoint data to imitate, no decoys are laid out.
+func (w *Writer) SetDecoys(n int) {
+	w.ndecoy = n
+}
+
+// Set whether entrypoint data is scattered through the header
+// at pseudo-randomly derived positions, like the suites' points,
+// rather than packed into the first free space after them,
+// affecting subsequent calls to Layout().
+// Each entrypoint's alternative positions derive from the position domain,
+// its suite and its public key, so the entrypoint's owner can derive
+// the same positions; Layout() picks the lowest one not yet reserved.
+// Scattering avoids a contiguous, identifiable block of entrypoints,
+// usually at the cost of a longer header.
+func (w *Writer) SetScatterPayloads(scatter bool) {
+	w.scatter = scatter
+}
+
+// Set whether Write() wipes the ephemeral Diffie-Hellman secrets
+// and derived shared keys once it has encrypted the entrypoints,
+// affecting subsequent calls to Write() and its variants.
+// Wiping is on by default, as a defense in depth
+// against later leaks of the Writer's memory;
+// it is best-effort, since the underlying big-number representations
+// may leave copies of secret values that Go offers no way to clear.
+func (w *Writer) SetWipe(wipe bool) {
+	w.nowipe = !wipe
+}
+
+// Set the alignment of entrypoint data and payload regions,
+// affecting subsequent calls to Layout() and Payload().
+// Each such region then starts at a multiple of n bytes
+// from the start of the header, e.g., for cache-line alignment,
+// possibly at the cost of a longer header.
+// An alignment of 0 or 1 means regions are packed without gaps.
+func (w *Writer) SetPayloadAlign(n int) {
+	w.align = n
+}
+
+// Return the alignment for entrypoint data and payload regions.
+func (w *Writer) payloadAlign() int {
+	if w.align < 1 {
+		return 1
+	}
+	return w.align
+}
+
+// Set a key for an optional MAC over the whole header,
+// affecting subsequent calls to Layout() and Write().
+// Layout() reserves HeaderMACLen bytes at the very end of the header,
+// after the suffix if any, and includes them in the header length.
+// Write() fills them with an HMAC-SHA256 over the rest of the header,
+// so that parties sharing the key can detect tampering via VerifyHeaderMAC()
+// before probing for entrypoints.
+// Point positions extending into the MAC don't exist,
+// so readers should strip the MAC before looking for their points.
+// A nil key disables the header MAC.
+func (w *Writer) SetHeaderMAC(key []byte) {
+	w.mackey = key
+}
+
+// Return the length of the header MAC region: HeaderMACLen or 0.
+func (w *Writer) macLen() int {
+	if w.mackey == nil {
+		return 0
+	}
+	return HeaderMACLen
+}
+
+// Compute the header MAC over the given header bytes, excluding the MAC.
+func headerMAC(key, body []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// Verify the MAC at the end of a header produced with SetHeaderMAC(),
+// in constant time, returning true if the header is intact.
+func VerifyHeaderMAC(key, header []byte) bool {
+	if len(header) < HeaderMACLen {
+		return false
+	}
+	end := len(header) - HeaderMACLen
+	return hmac.Equal(headerMAC(key, header[:end]), header[end:])
+}
+
+// Return the suffix to be placed at the end of the header,
+// whose length was set by SetSuffixLen().
+func (w *Writer) Suffix() []byte {
+	return w.suffix
+}
+
+// Cheaply check whether Layout() might fit the given ciphersuites
+// and numEntries entrypoints with entryLen bytes of data each
+// within the maximum header length set by SetMaxLen(),
+// e.g., to reject oversized requests before attempting a real layout.
+// Returns false only if the layout definitely won't fit:
+// when the suites' points, the entrypoints, any decoys, suffix,
+// and header MAC together need more bytes than the maximum,
+// or when the request exceeds the suite or entrypoint limits.
+// Returns true otherwise, though Layout() may still fail,
+// since the check ignores position conflicts.
+func (w *Writer) CanFit(suiteLevel map[abstract.Suite]int,
+	entryLen int, numEntries int) bool {
+	if w.maxEnts != 0 && numEntries > w.maxEnts {
+		return false
+	}
+	suiteLevel = w.allLevels(suiteLevel)
+	if len(suiteLevel) > 255 {
+		return false
+	}
+	if w.maxLen == 0 || w.soft {
+		return true // Layout() never fails for lack of space
+	}
+	if w.nodata {
+		entryLen = 0
+	} else if w.shared != nil {
+		entryLen = len(w.shared)
+	}
+	if entryLen > 0 {
+		entryLen += w.entryOverhead()
+	}
+
+	// Every suite's primary point and every region is disjoint.
+	need := MinHeaderSize(suiteLevel, entryLen, numEntries)
+	if numEntries > 0 {
+		need += w.ndecoy * entryLen
+	}
+	need += len(w.suffix) + w.macLen()
+	return need <= w.maxLen
+}
+
+// Return the suiteLevel map extended with the fixed suite set, if any.
+func (w *Writer) allLevels(
+	suiteLevel map[abstract.Suite]int) map[abstract.Suite]int {
+	if w.fixed == nil {
+		return suiteLevel
+	}
+	all := DefaultLevels(w.fixed, len(w.fixed))
+	for suite, nlevels := range suiteLevel {
+		all[suite] = nlevels
+	}
+	return all
+}
+
+// Return the data to be encrypted into a given entrypoint.
+func (w *Writer) entryData(e *Entry) []byte {
+	if w.nodata {
+		return nil
+	}
+	if w.shared != nil {
+		return w.shared
+	}
+	return e.Data
+}
+
+// Derive a symmetric content key from the decrypted data of an entrypoint,
+// by absorbing the data into Cipher c and squeezing out KeySize() bytes.
+// The creator of the header and each entrypoint owner should call this
+// with identically-initialized Ciphers, typically unkeyed ones
+// from the entrypoint's suite, e.g., suite.Cipher(abstract.NoKey),
+// so that all parties arrive at the same key for the "real" content.
+// The state of c is advanced by the call.
+func DeriveContentKey(c abstract.Cipher, entrypointData []byte) []byte {
+	key := make([]byte, c.KeySize())
+	c.Message(nil, nil, entrypointData)
+	c.Message(key, nil, nil)
+	return key
+}
+
+// Preallocate space for laying out about nsuites ciphersuites,
+// reducing memory allocation during subsequent calls to Layout().
+// This is only a performance hint, like strings.Builder.Grow:
+// Layout() handles any number of ciphersuites regardless.
+func (w *Writer) Grow(nsuites int) {
+	if cap(w.suites.s) < nsuites {
+		w.suites.s = make([]*suiteInfo, 0, nsuites)
+	}
+	if cap(w.infos) < nsuites {
+		w.infos = make([]suiteInfo, 0, nsuites)
+	}
+
+	// Each suite reserves one primary position in the layout,
+	// plus all positions up to about its default level in exclude.
+	w.layout.grow(2 * nsuites)
+	w.exclude.grow(nsuites * LevelsFor(nsuites))
+}
+
+// Compute the recommended level for a ciphersuite,
+// i.e., the number of levels of alternative point positions,
+// given the maximum number of ciphersuites likely ever to share a header:
+// ceil(log2(maxSuites)), or 1 if maxSuites is less than 2,
+// since level 0 alone holds only the single position at offset 0.
+// The level must be standardized along with each ciphersuite,
+// since it determines where the suite's point may appear,
+// and all participants must use the same one.
+func LevelsFor(maxSuites int) int {
+	level := 1
+	for 1<<uint(level) < maxSuites {
+		level++
+	}
+	return level
+}
+
+// Compute the information-theoretic minimum header size
+// for the ciphersuites in suiteLevel and numEntries entrypoints
+// of entryLen bytes each: one hiding-encoded point per suite
+// plus the entrypoint data, ignoring any collisions between positions.
+// Comparing a Layout's actual header length against this floor
+// shows how much the header grows due to point position collisions.
+func MinHeaderSize(suiteLevel map[abstract.Suite]int,
+	entryLen, numEntries int) int {
+	size := 0
+	for suite := range suiteLevel {
+		if h, ok := suite.Point().(abstract.Hiding); ok {
+			size += h.HideLen()
+		}
+	}
+	return size + entryLen*numEntries
+}
+
+// Compute the recommended suiteLevel map for Layout(),
+// assigning each of the given ciphersuites the level LevelsFor(maxSuites).
+// All participants must agree on maxSuites,
+// since the level of each ciphersuite determines where its point may appear.
+func DefaultLevels(suites []abstract.Suite,
+	maxSuites int) map[abstract.Suite]int {
+	level := LevelsFor(maxSuites)
+	suiteLevel := make(map[abstract.Suite]int)
+	for _, suite := range suites {
+		suiteLevel[suite] = level
+	}
+	return suiteLevel
+}
+
+// Estimate how often ciphersuites' point positions collide
+// badly enough to push some suite to a higher level,
+// to help choose level bounds for a given set of ciphersuites.
+// Runs the given number of trial layouts of the ciphersuites in suiteLevels,
+// each under a different random position domain (see SetPositionDomain),
+// and returns the fraction of trials in which some suite
+// could use neither its level 0 nor its level 1 position,
+// or could not be laid out at all.
+// Since every suite's level 0 position is at offset 0,
+// only the first suite laid out can ever use it,
+// so level 1 is the lowest level whose collisions indicate congestion.
+// The trials bypass the position cache (see SetSuiteCacheSize),
+// since their one-off domains would only evict useful entries.
+// Returns 0 if trials is not positive.
+func ConflictProbability(suiteLevels map[abstract.Suite]int, trials int,
+	rand cipher.Stream) float64 {
+	if trials <= 0 {
+		return 0
+	}
+	congested := 0
+	for i := 0; i < trials; i++ {
+		w := Writer{nocache: true}
+		w.SetPositionDomain(fmt.Sprintf("%x:", random.Bytes(16, rand)))
+		if _, err := w.Layout(suiteLevels, nil, rand); err != nil {
+			congested++
+			continue
+		}
+		for _, si := range w.suites.s {
+			if si.lev > 1 {
+				congested++
+				break
+			}
+		}
+	}
+	return float64(congested) / float64(trials)
 }
 
 // Initialize a Writer to produce one or more negotiation header
@@ -188,6 +834,7 @@ func (w *Writer) SetMaxLen(max int) {
 // After this initialization and layout computation,
 // multiple independent negotiation headers with varying entrypoint data
 // may be produced more efficiently via Write().
+// Layout() draws from rand only if SetOptimize() is enabled.
 //
 // XXX if multiple entrypoints are improperly passed for the same keyholder,
 // bad things happen to security - we should harden the API against that.
@@ -196,10 +843,26 @@ func (w *Writer) Layout(suiteLevel map[abstract.Suite]int,
 	entrypoints []Entry,
 	rand cipher.Stream) (int, error) {
 
-	w.layout.reset()
+	if w.maxEnts != 0 && len(entrypoints) > w.maxEnts {
+		return 0, errors.New("too many entrypoints")
+	}
+
 	w.entries = entrypoints
-	w.entofs = make(map[int]int)
 	w.buf = nil
+	suiteLevel = w.allLevels(suiteLevel)
+	if w.single && len(suiteLevel) > 1 {
+		return 0, errors.New("single-level mode supports only one suite")
+	}
+
+	// Suite positions derive from suite names, so names must be unique.
+	names := make(map[string]bool)
+	for suite := range suiteLevel {
+		name := suite.String()
+		if names[name] {
+			return 0, errors.New("distinct suites named " + name)
+		}
+		names[name] = true
+	}
 
 	// Determine the set of ciphersuites in use.
 	/*
@@ -215,18 +878,31 @@ func (w *Writer) Layout(suiteLevel map[abstract.Suite]int,
 
 	// Compute the alternative DH point positions for each ciphersuite,
 	// and the maximum byte offset for each.
-	w.suites.s = make([]*suiteInfo, 0, len(suiteLevel))
+	if cap(w.suites.s) < len(suiteLevel) {
+		w.suites.s = make([]*suiteInfo, 0, len(suiteLevel))
+	}
+	if cap(w.infos) < len(suiteLevel) {
+		w.infos = make([]suiteInfo, 0, len(suiteLevel))
+	}
+	w.suites.s = w.suites.s[:0]
+	w.infos = w.infos[:0]
 	max := 0
-	simap := make(map[abstract.Suite]*suiteInfo)
+	simap := make(map[abstract.Suite]*suiteInfo, len(suiteLevel))
 	w.simap = simap
 	for suite, nlevels := range suiteLevel {
-		si := suiteInfo{}
-		si.init(suite, nlevels)
+		if w.single && nlevels > 1 {
+			nlevels = 1
+		}
+		w.infos = append(w.infos, suiteInfo{})
+		si := &w.infos[len(w.infos)-1]
+		if err := w.initSuite(si, suite, nlevels); err != nil {
+			return 0, err
+		}
 		if si.max > max {
 			max = si.max
 		}
-		w.suites.s = append(w.suites.s, &si)
-		simap[suite] = &si
+		w.suites.s = append(w.suites.s, si)
+		simap[suite] = si
 	}
 	nsuites := len(w.suites.s)
 	if nsuites > 255 {
@@ -234,6 +910,7 @@ func (w *Writer) Layout(suiteLevel map[abstract.Suite]int,
 		// more than 255 ciphersuites.
 		return 0, errors.New("too many ciphersuites")
 	}
+	full := max
 	if w.maxLen != 0 && max > w.maxLen {
 		max = w.maxLen
 	}
@@ -241,8 +918,132 @@ func (w *Writer) Layout(suiteLevel map[abstract.Suite]int,
 	// Sort the ciphersuites in order of max position,
 	// to give ciphersuites with most restrictive positioning
 	// "first dibs" on the lowest positions.
+	// Ties are broken by suite name so the layout is reproducible.
 	sort.Sort(&w.suites)
 
+	w.over = false
+	hdrlen, err := w.arrange(max)
+	if w.compact {
+		hdrlen, err = w.optimizeOrder(max, hdrlen, err, rand)
+	}
+
+	// Exceed a soft maximum length rather than fail.
+	if err != nil && w.soft && w.maxLen != 0 {
+		limit := w.maxLen
+		w.maxLen = 0
+		hdrlen, err = w.arrange(full)
+		if w.compact {
+			hdrlen, err = w.optimizeOrder(full, hdrlen, err, rand)
+		}
+		w.maxLen = limit
+		w.over = err == nil && hdrlen > limit
+	}
+	if err != nil {
+		return 0, err
+	}
+	w.hdrlen = hdrlen
+	return hdrlen, nil
+}
+
+// Initialize si for a ciphersuite with nlevels levels
+// under the Writer's position configuration,
+// using the suite's fixed positions from SetSuitePositions(), if any.
+func (w *Writer) initSuite(si *suiteInfo, suite abstract.Suite,
+	nlevels int) error {
+	fixed := w.fixpos[suite]
+	if fixed != nil {
+		nlevels = len(fixed)
+		if w.single && nlevels > 1 {
+			nlevels = 1
+		}
+	}
+	err := si.derive(suite, nlevels, w.domain, w.order, w.poshash,
+		w.poshash == nil && !w.nocache)
+	if err != nil || fixed == nil {
+		return err
+	}
+	for i := range si.pos {
+		lo := fixed[i]
+		if lo < 0 || (i > 0 && lo < si.pos[i-1]+si.plen) {
+			return errors.New("suite " + suite.String() +
+				" has overlapping or unordered fixed positions")
+		}
+		si.pos[i] = lo
+	}
+	si.max = si.pos[nlevels-1] + si.plen
+	return nil
+}
+
+// Run the placement algorithm of Layout() on the ciphersuites in suiteLevel
+// under the Writer's current configuration, without entrypoints,
+// returning the level each suite's point would use
+// and the resulting header length, but leaving the Writer untouched,
+// so that the caller can cheaply compare several suiteLevel maps
+// before laying out the header for real.
+func (w *Writer) DryRun(suiteLevel map[abstract.Suite]int) (
+	map[abstract.Suite]int, int, error) {
+	d := *w
+	d.layout = skipLayout{}
+	d.exclude = skipLayout{}
+	d.suites.s = nil
+	d.infos = nil
+	d.simap = nil
+	d.buf = nil
+	hdrlen, err := d.Layout(suiteLevel, nil, random.Stream)
+	if err != nil {
+		return nil, 0, err
+	}
+	levels := make(map[abstract.Suite]int, len(d.simap))
+	for suite, si := range d.simap {
+		levels[suite] = si.lev
+	}
+	return levels, hdrlen, nil
+}
+
+// Reserve a pseudo-randomly derived position for an entrypoint's l bytes,
+// for SetScatterPayloads().
+// As with points, level i offers one of 1<<i slots in its own table,
+// and the entrypoint takes the lowest level whose slot is still free.
+// Slots are l bytes rounded up to the payload alignment.
+func (w *Writer) scatterEntry(e *Entry, l int) (int, error) {
+	order := w.order
+	if order == nil {
+		order = binary.BigEndian
+	}
+	align := w.payloadAlign()
+	slot := (l + align - 1) / align * align
+
+	pub, _ := e.PubKey.MarshalBinary()
+	str := fmt.Sprintf("%sNegoEntrypoint:%s:%x", w.domain, e.Suite, pub)
+	rand := positionStream(e.Suite, []byte(str), w.poshash)
+
+	levofs := 0
+	for i := 0; i < 31; i++ {
+		var buf [4]byte
+		rand.XORKeyStream(buf[:], buf[:])
+		levlen := 1 << uint(i)
+		levidx := int(order.Uint32(buf[:])) & (levlen - 1)
+		lo := levofs + levidx*slot
+		if w.maxLen != 0 && lo+l > w.maxLen {
+			break
+		}
+		if w.layout.reserve(lo, lo+l, true, e.String()) {
+			return lo, nil
+		}
+		levofs += levlen * slot
+	}
+	return 0, errors.New("no viable position for entrypoint " +
+		e.String())
+}
+
+// Lay out the points of all ciphersuites in the order of w.suites,
+// within a header of at most max bytes, followed by the entrypoints
+// and the suffix, if any, and return the resulting header length.
+func (w *Writer) arrange(max int) (int, error) {
+	w.layout.reset()
+	w.entofs = make(map[int]int)
+	w.entlens = make([]int, len(w.entries))
+
 	// Create two reservation layouts:
 	// - In w.layout only each ciphersuite's primary position is reserved.
 	// - In exclude we reserve _all_ positions in each ciphersuite.
@@ -250,27 +1051,40 @@ func (w *Writer) Layout(suiteLevel map[abstract.Suite]int,
 	// each successive ciphersuite's primary position must not overlap
 	// any point position for any ciphersuite previously computed,
 	// but can overlap positions for ciphersuites to be computed later.
-	var exclude skipLayout
+	exclude := &w.exclude
 	exclude.reset()
+	w.clashes = nil
+	owners := make(map[string]abstract.Suite)
 	hdrlen := 0
-	for i := 0; i < nsuites; i++ {
+	for i := range w.suites.s {
 		si := w.suites.s[i]
+		owners[si.String()] = si.ste
 		//fmt.Printf("max %d: %s\n", si.max, si.ste.String())
 
+		// Positions beyond the maximum header length are unusable.
+		lev := len(si.pos)
+		for lev > 0 && si.pos[lev-1]+si.plen > max {
+			lev--
+		}
+		top := lev
+
 		// Reserve all our possible positions in exclude layout,
 		// picking the first non-conflicting position as our primary.
-		lev := len(si.pos)
-		for j := lev - 1; j >= 0; j-- {
+		for j := len(si.pos) - 1; j >= 0; j-- {
 			lo := si.pos[j]
 			hi := lo + si.plen
 			//fmt.Printf("reserving [%d-%d]\n", lo,hi)
+			if owner := exclude.owner(lo, hi); owner != "" && j < top {
+				w.clashes = append(w.clashes,
+					ConflictEvent{si.ste, j, owners[owner]})
+			}
 			name := si.String()
 			if exclude.reserve(lo, hi, false, name) && j == lev-1 {
 				lev = j // no conflict, shift down
 			}
 		}
-		if lev == len(si.pos) {
-			return 0, errors.New("no viable position for suite" +
+		if lev == top {
+			return 0, errors.New("no viable position for suite " +
 				si.ste.String())
 		}
 		si.lev = lev // lowest unconflicted, non-shadowed level
@@ -287,33 +1101,366 @@ func (w *Writer) Layout(suiteLevel map[abstract.Suite]int,
 		}
 	}
 
-	fmt.Printf("Total hdrlen: %d\n", hdrlen)
+	//fmt.Printf("Total hdrlen: %d\n", hdrlen)
 	//fmt.Printf("Point layout:\n")
 	//w.layout.dump()
 
 	// Now layout the entrypoints.
-	for i := range entrypoints {
-		e := &entrypoints[i]
-		si := simap[e.Suite]
+	for i := range w.entries {
+		e := &w.entries[i]
+		si := w.simap[e.Suite]
 		if si == nil {
 			panic("suite " + e.Suite.String() + " wasn't on the list")
 		}
-		l := len(e.Data)
+		if w.nodata {
+			if len(e.Data) != 0 {
+				return 0, errors.New("presence-only entrypoint " +
+					e.String() + " has data")
+			}
+			continue
+		}
+		l := len(w.entryData(e))
 		if l == 0 {
-			panic("entrypoint with no data")
+			return 0, errors.New("entrypoint " + e.String() +
+				" has no data")
+		}
+		if l > maxEntryLen {
+			return 0, errors.New("entrypoint " + e.String() +
+				" has too much data")
+		}
+		w.entlens[i] = l
+		l += w.entryOverhead()
+
+		// Since w.layout holds every suite's primary point position,
+		// alloc routes payloads around the points.
+		// Payloads may overlap non-primary positions, which is harmless
+		// since Write XORs those into the primaries after encryption.
+		var ofs int
+		if w.scatter {
+			var err error
+			if ofs, err = w.scatterEntry(e, l); err != nil {
+				return 0, err
+			}
+		} else {
+			ofs = w.layout.allocAlign(l, w.payloadAlign(), e.String())
 		}
-		ofs := w.layout.alloc(l, e.String())
 		w.entofs[i] = ofs
+		if ofs+l > hdrlen {
+			hdrlen = ofs + l
+		}
+		if w.maxLen != 0 && hdrlen > w.maxLen {
+			return 0, errors.New("entrypoints exceed maximum length")
+		}
 		//fmt.Printf("Entrypoint %d (%s) at [%d-%d]\n",
 		//	i, si.String(), ofs, ofs+l)
 	}
 
+	// Reserve decoys shaped like the longest entrypoint and its overhead.
+	w.decoys = nil
+	w.declen = 0
+	for _, l := range w.entlens {
+		if l > w.declen {
+			w.declen = l
+		}
+	}
+	if w.declen > 0 {
+		w.declen += w.entryOverhead()
+	}
+	for i := 0; i < w.ndecoy && w.declen > 0; i++ {
+		ofs := w.layout.allocAlign(w.declen, w.payloadAlign(), "decoy")
+		w.decoys = append(w.decoys, ofs)
+		if ofs+w.declen > hdrlen {
+			hdrlen = ofs + w.declen
+		}
+		if w.maxLen != 0 && hdrlen > w.maxLen {
+			return 0, errors.New("decoys exceed maximum length")
+		}
+	}
+
+	// Reserve the suffix region after everything else.
+	if l := len(w.suffix); l > 0 {
+		if !w.layout.reserve(hdrlen, hdrlen+l, true, "suffix") {
+			panic("suffix region not free??")
+		}
+		hdrlen += l
+		if w.maxLen != 0 && hdrlen > w.maxLen {
+			return 0, errors.New("suffix exceeds maximum length")
+		}
+	}
+
+	// Reserve the header MAC region after that.
+	if l := w.macLen(); l > 0 {
+		if !w.layout.reserve(hdrlen, hdrlen+l, true, "mac") {
+			panic("MAC region not free??")
+		}
+		hdrlen += l
+		if w.maxLen != 0 && hdrlen > w.maxLen {
+			return 0, errors.New("header MAC exceeds maximum length")
+		}
+	}
+
 	//fmt.Printf("Point+Entry layout:\n")
 	//w.layout.dump()
 
 	return hdrlen, nil
 }
 
+// Number of alternative suite orders optimizeOrder() tries.
+const optimizeTries = 100
+
+// Search for an order of w.suites yielding a shorter header than
+// the initial order, whose arrangement yielded hdrlen and err,
+// by repeatedly swapping two suites picked via rand
+// and keeping the swap if arrange() then succeeds with a shorter header.
+// Any order is valid, provided Write() computes points in the same order.
+// Leaves the Writer arranged in the best order found.
+func (w *Writer) optimizeOrder(max, hdrlen int, err error,
+	rand cipher.Stream) (int, error) {
+	s := w.suites.s
+	if len(s) < 2 {
+		return hdrlen, err
+	}
+	best, bestErr := hdrlen, err
+	for try := 0; try < optimizeTries; try++ {
+		i := int(random.Uint32(rand) % uint32(len(s)))
+		j := int(random.Uint32(rand) % uint32(len(s)))
+		s[i], s[j] = s[j], s[i]
+		l, err := w.arrange(max)
+		if err == nil && (bestErr != nil || l < best) {
+			best, bestErr = l, nil
+		} else {
+			s[i], s[j] = s[j], s[i] // undo
+		}
+	}
+	return w.arrange(max)
+}
+
+// After Layout() has been called to layout the header,
+// return an independent copy of the Writer with the same layout,
+// on which Write(), Payload(), and AddSuite() may be called
+// concurrently with calls on the original or on other clones.
+// The clone has its own copy of the entrypoint list,
+// but shares the entrypoints' Data slices with the original.
+func (w *Writer) Clone() *Writer {
+	c := *w
+	c.layout = w.layout.clone()
+	c.exclude = w.exclude.clone()
+	c.entries = append([]Entry(nil), w.entries...)
+	c.clashes = append([]ConflictEvent(nil), w.clashes...)
+	c.infos = nil
+	c.buf = nil
+
+	// Give the clone its own suiteInfos for its ephemeral keys.
+	c.suites.s = make([]*suiteInfo, len(w.suites.s))
+	c.simap = make(map[abstract.Suite]*suiteInfo, len(w.suites.s))
+	for i, si := range w.suites.s {
+		nsi := *si
+		c.suites.s[i] = &nsi
+		c.simap[nsi.ste] = &nsi
+	}
+	if w.simap == nil {
+		c.simap = nil
+	}
+	return &c
+}
+
+// After Layout() has been called to layout the header,
+// the client may call AddSuite() to add a ciphersuite to the layout
+// without disturbing any existing point or entrypoint reservations.
+// The new suite's primary point position is the lowest of its nlevels
+// alternative positions that conflicts with neither any existing reservation
+// nor any alternative position of a previously laid-out suite.
+// With a suffix or header MAC (see SetSuffixLen() and SetHeaderMAC()),
+// which must stay at the end, the position must also lie
+// within the existing header, and within the maximum length
+// set by SetMaxLen(), if any.
+// A soft maximum length set by SetMaxLenSoft() may be exceeded,
+// as reported by OverMaxLen().
+// Returns an error if no such non-conflicting position exists.
+func (w *Writer) AddSuite(suite abstract.Suite, nlevels int) error {
+	if w.simap == nil {
+		return errors.New("AddSuite called before Layout")
+	}
+	if w.simap[suite] != nil {
+		return errors.New("suite " + suite.String() + " already laid out")
+	}
+	for _, si := range w.suites.s {
+		if si.ste.String() == suite.String() {
+			return errors.New("distinct suites named " + suite.String())
+		}
+	}
+	if w.single {
+		return errors.New("single-level mode supports only one suite")
+	}
+	if len(w.suites.s) >= 255 {
+		return errors.New("too many ciphersuites")
+	}
+
+	si := suiteInfo{}
+	if err := w.initSuite(&si, suite, nlevels); err != nil {
+		return err
+	}
+
+	// The suffix and header MAC must stay at the end of the header,
+	// so the new point can't extend the header past them,
+	// nor past a hard maximum length.
+	limit := 0
+	if len(w.suffix) > 0 || w.macLen() > 0 {
+		limit = w.hdrlen
+	} else if w.maxLen != 0 && !w.soft {
+		limit = w.maxLen
+	}
+
+	// Since the new suite's point gets computed last,
+	// only its primary position must avoid everything already reserved.
+	lev := -1
+	for j := range si.pos {
+		lo, hi := si.region(j)
+		if limit != 0 && hi > limit {
+			break
+		}
+		if !w.exclude.overlaps(lo, hi) && !w.layout.overlaps(lo, hi) {
+			lev = j
+			break
+		}
+	}
+	if lev < 0 {
+		return errors.New("no viable position for suite " +
+			suite.String())
+	}
+	si.lev = lev
+
+	name := si.String()
+	for j := range si.pos {
+		lo, hi := si.region(j)
+		w.exclude.reserve(lo, hi, false, name)
+	}
+	lo, hi := si.region(lev)
+	if !w.layout.reserve(lo, hi, true, name) {
+		panic("thought we had that position reserved??")
+	}
+	if hi > w.hdrlen {
+		w.hdrlen = hi
+		if w.maxLen != 0 && hi > w.maxLen {
+			w.over = true
+		}
+	}
+
+	w.suites.s = append(w.suites.s, &si)
+	w.simap[suite] = &si
+	return nil
+}
+
+// JSON representation of a Writer's layout, for use by external tools.
+type layoutJSON struct {
+	HdrLen  int         `json:"hdrlen"`
+	Points  []pointJSON `json:"points"`
+	Entries []entryJSON `json:"entries"`
+}
+
+// Reserved primary position of a ciphersuite's Diffie-Hellman point.
+type pointJSON struct {
+	Suite string `json:"suite"`
+	Level int    `json:"level"`
+	Lo    int    `json:"lo"`
+	Hi    int    `json:"hi"`
+}
+
+// Reserved position of an entrypoint, identified by its index in the
+// entrypoints slice passed to Layout().
+type entryJSON struct {
+	Entry int    `json:"entry"`
+	Suite string `json:"suite"`
+	Lo    int    `json:"lo"`
+	Hi    int    `json:"hi"`
+}
+
+// After Layout() has been called to layout the header,
+// return a JSON description of the layout, for tools such as visualizers.
+// The description includes the header length,
+// the chosen level and reserved byte range of each ciphersuite's point
+// in the order in which the points are computed,
+// and the reserved byte range of each entrypoint in entrypoint order,
+// covering its data, its version byte and its MAC, if any.
+func (w *Writer) LayoutJSON() ([]byte, error) {
+	if w.simap == nil {
+		return nil, errors.New("LayoutJSON called before Layout")
+	}
+	lj := layoutJSON{HdrLen: w.hdrlen}
+	lj.Points = make([]pointJSON, 0, len(w.suites.s))
+	for _, si := range w.suites.s {
+		lo, hi := si.region(si.lev)
+		lj.Points = append(lj.Points,
+			pointJSON{si.ste.String(), si.lev, lo, hi})
+	}
+	lj.Entries = make([]entryJSON, 0, len(w.entries))
+	for i := range w.entries {
+		e := &w.entries[i]
+		lo := w.entofs[i]
+		hi := lo + len(w.entryData(e))
+		if hi == lo {
+			continue // presence-only
+		}
+		hi += w.entryOverhead()
+		lj.Entries = append(lj.Entries,
+			entryJSON{i, e.Suite.String(), lo, hi})
+	}
+	return json.Marshal(&lj)
+}
+
+// After Layout() has been called to layout the header,
+// call fn for each entrypoint with the byte range reserved for its data,
+// its version byte and its MAC, if any
+// (see SetEntryVersion() and SetEntryMACLen()),
+// in ascending order of offset, e.g., for custom serialization or debugging.
+// Presence-only entrypoints reserve no data and are skipped.
+func (w *Writer) EachEntry(fn func(e Entry, lo, hi int)) {
+	idx := make([]int, 0, len(w.entries))
+	for i := range w.entries {
+		if i < len(w.entlens) && w.entlens[i] > 0 {
+			idx = append(idx, i)
+		}
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		return w.entofs[idx[a]] < w.entofs[idx[b]]
+	})
+	for _, i := range idx {
+		lo := w.entofs[i]
+		fn(w.entries[i], lo, lo+w.entlens[i]+w.entryOverhead())
+	}
+}
+
+// Return the byte ranges that the last call to Layout() considered occupied
+// by point positions, in order of offset: every alternative position
+// of every ciphersuite, named after the first suite to claim it.
+// A suite could use a level as its primary position only if
+// that level's position didn't overlap any range claimed before it,
+// so these ranges, along with Conflicts(), explain the levels chosen.
+func (w *Writer) ExcludedRanges() []Reservation {
+	return w.exclude.ranges()
+}
+
+// Return the point position conflicts found by the last call to Layout(),
+// in the order found, which shows which ciphersuites compete for positions
+// and hence push each other to higher levels and lengthen the header.
+func (w *Writer) Conflicts() []ConflictEvent {
+	return w.clashes
+}
+
+// Return the number of header bytes that Write() will fill with random bits,
+// i.e., the header length computed by Layout() minus the extents
+// reserved for ciphersuites' primary points, entrypoint payloads,
+// and any decoys, suffix, or header MAC.
+// A large fill relative to the header length suggests a sparse layout,
+// which tighter suite levels might compact.
+func (w *Writer) FillBytes() int {
+	fill := 0
+	w.layout.scanFree(func(lo, hi int) {
+		fill += hi - lo
+	}, w.hdrlen)
+	return fill
+}
+
 // Grow the message buffer to include the region from lo to hi,
 // and return a slice representing that region.
 func (w *Writer) growBuf(lo, hi int) []byte {
@@ -341,7 +1488,7 @@ func (w *Writer) Payload(data []byte, encrypt cipher.Stream) int {
 	}
 
 	// Allocate space for the payload
-	lo := w.layout.alloc(l, "payload")
+	lo := w.layout.allocAlign(l, w.payloadAlign(), "payload")
 	hi := lo + l
 
 	// Expand the message buffer capacity as needed
@@ -353,10 +1500,74 @@ func (w *Writer) Payload(data []byte, encrypt cipher.Stream) int {
 	return lo
 }
 
+// Check that each entrypoint's data still has the length it was laid out for,
+// since the caller may have replaced the data slices after Layout().
+// Returns an error listing the mismatched entrypoints, if any.
+func (w *Writer) checkEntries() error {
+	if len(w.entlens) != len(w.entries) {
+		return errors.New("entrypoints not laid out")
+	}
+	bad := ""
+	for i := range w.entries {
+		e := &w.entries[i]
+		if len(w.entryData(e)) != w.entlens[i] {
+			if bad != "" {
+				bad += ", "
+			}
+			bad += e.String()
+		}
+	}
+	if bad != "" {
+		return errors.New("entrypoint data length differs from layout: " +
+			bad)
+	}
+	return nil
+}
+
+// Check that a caller-supplied random stream still produces output,
+// by drawing a few bytes from it, so that an exhausted or broken stream
+// yields an error rather than a header with all-zero fill.
+// This can't detect a stream that runs out partway through a header,
+// so callers must supply an unbounded stream regardless.
+func checkStream(rand cipher.Stream) error {
+	var buf [16]byte
+	rand.XORKeyStream(buf[:], buf[:])
+	for _, b := range buf {
+		if b != 0 {
+			return nil
+		}
+	}
+	return errors.New("random stream produced no output")
+}
+
+// Check that the Writer is ready to produce a header from a given stream.
+func (w *Writer) checkWrite(rand cipher.Stream) error {
+	if err := w.checkEntries(); err != nil {
+		return err
+	}
+	return checkStream(rand)
+}
+
 // Finalize and encrypt the negotiation message.
 // The data slices in all the entrypoints must be filled in
-// before calling this function.
+// before calling this function,
+// with the same lengths they had when Layout() was called;
+// Write panics if any length differs, as the header would be corrupt.
+// The rand stream must be unbounded, like random.Stream,
+// as Write may draw arbitrarily many bytes from it;
+// Write panics if the stream produces no output.
+// Unless disabled with SetWipe(false), Write wipes the ephemeral secrets
+// it used to encrypt the entrypoints before returning.
 func (w *Writer) Write(rand cipher.Stream) []byte {
+	if err := w.checkWrite(rand); err != nil {
+		panic(err.Error())
+	}
+	return w.write(rand)
+}
+
+// Produce the negotiation message once Write or a variant
+// has checked the Writer and rand stream.
+func (w *Writer) write(rand cipher.Stream) []byte {
 
 	// Pick an ephemeral secret for each ciphersuite
 	// that produces a hide-encodable Diffie-Hellman public key.
@@ -380,6 +1591,7 @@ func (w *Writer) Write(rand cipher.Stream) []byte {
 		}
 		si.pri = pri
 		si.pub = buf
+		si.pnt = pub
 
 		// Insert the hidden point into the message buffer.
 		lo, hi := si.region(si.lev)
@@ -392,16 +1604,63 @@ func (w *Writer) Write(rand cipher.Stream) []byte {
 		e := &w.entries[i]
 		si := w.simap[e.Suite]
 		lo := w.entofs[i]
-		hi := lo + len(e.Data)
+		data := w.entryData(e)
+		hi := lo + len(data)
+		if len(data) == 0 {
+			continue // presence-only
+		}
 
 		// Form the shared secret with this keyholder.
 		dhkey := si.ste.Point().Mul(e.PubKey, si.pri)
 
-		// Encrypt the entrypoint data with it.
+		// Encrypt the entrypoint data with it, after the version byte
+		// if any, authenticating the ciphertext if entrypoints carry MACs.
 		buf, _ := dhkey.MarshalBinary()
 		stream := si.ste.Cipher(buf)
+		if w.hasver {
+			vbuf := w.growBuf(lo, lo+1)
+			ver := []byte{w.entver}
+			if w.entmac > 0 {
+				stream.Partial(vbuf, ver, vbuf)
+			} else {
+				stream.XORKeyStream(vbuf, ver)
+			}
+			lo++
+			hi++
+		}
 		msgbuf := w.growBuf(lo, hi)
-		stream.XORKeyStream(msgbuf, e.Data)
+		if w.entmac > 0 {
+			stream.Message(msgbuf, data, msgbuf)
+			stream.Message(w.growBuf(hi, hi+w.entmac), nil, nil)
+		} else {
+			stream.XORKeyStream(msgbuf, data)
+		}
+		if !w.nowipe {
+			for j := range buf {
+				buf[j] = 0
+			}
+			dhkey.Null()
+		}
+	}
+
+	// Wipe the ephemeral secrets, now that all entrypoints are encrypted.
+	if !w.nowipe {
+		for _, si := range w.suites.s {
+			si.pri.Zero()
+			si.pri = nil
+		}
+	}
+
+	// Place the suffix, if any, at the end of the header before the MAC.
+	if l := len(w.suffix); l > 0 {
+		end := w.hdrlen - w.macLen()
+		copy(w.growBuf(end-l, end), w.suffix)
+	}
+
+	// Fill the decoys with random bits.
+	for _, ofs := range w.decoys {
+		msgbuf := w.growBuf(ofs, ofs+w.declen)
+		rand.XORKeyStream(msgbuf, msgbuf)
 	}
 
 	// Fill all unused parts of the message with random bits.
@@ -412,6 +1671,11 @@ func (w *Writer) Write(rand cipher.Stream) []byte {
 	}, msglen)
 
 	// Finally, XOR-encode all the hidden Diffie-Hellman public keys.
+	// With a header MAC, positions extending into the MAC don't exist.
+	msglen = len(w.buf)
+	if w.mackey != nil {
+		msglen = w.hdrlen - HeaderMACLen
+	}
 	for i := range w.suites.s {
 		si := w.suites.s[i]
 		plen := si.plen
@@ -422,10 +1686,11 @@ func (w *Writer) Write(rand cipher.Stream) []byte {
 		copy(pbuf, si.pub)
 
 		// XOR all the non-primary point positions into it.
+		// Positions extending past the end of the message don't exist.
 		for j := range si.pos {
-			if j != si.lev {
-				lo, hi := si.region(j)
-				buf := w.buf[lo:hi] // had better exist
+			lo, hi := si.region(j)
+			if j != si.lev && hi <= msglen {
+				buf := w.buf[lo:hi]
 				for k := 0; k < plen; k++ {
 					pbuf[k] ^= buf[k]
 				}
@@ -433,5 +1698,78 @@ func (w *Writer) Write(rand cipher.Stream) []byte {
 		}
 	}
 
+	// MAC the now-final header.
+	if w.mackey != nil {
+		mac := headerMAC(w.mackey, w.buf[:msglen])
+		copy(w.growBuf(msglen, w.hdrlen), mac)
+	}
+
 	return w.buf
 }
+
+// Finalize and encrypt the negotiation message like Write(),
+// but build it directly in dst starting at byte offset,
+// e.g., when the header is a prefix of a larger packet.
+// All point and entrypoint offsets remain relative to the header's start.
+// The dst slice must hold at least offset plus the header length bytes.
+// As with Write(), the entrypoints' Data slices supply their content,
+// but WriteAt returns an error rather than panicking on a length mismatch
+// or an exhausted rand stream.
+func (w *Writer) WriteAt(dst []byte, offset int, rand cipher.Stream) error {
+	if w.simap == nil {
+		return errors.New("WriteAt called before Layout")
+	}
+	if offset < 0 || len(dst)-offset < w.hdrlen {
+		return errors.New("destination too small for header")
+	}
+	if err := w.checkWrite(rand); err != nil {
+		return err
+	}
+	hdr := dst[offset : offset+w.hdrlen]
+	for i := range hdr {
+		hdr[i] = 0
+	}
+	w.buf = hdr
+	w.write(rand)
+	w.buf = nil // don't let later Writes scribble on dst
+	return nil
+}
+
+// Finalize and encrypt the negotiation message like Write(),
+// but emit it to out, returning the number of bytes written.
+// The entrypoints' Data slices supply their content as with Write().
+// This does not currently save memory over Write():
+// the whole message is still built in the Writer's buffer first,
+// since each point's final encoding is the XOR of the bytes
+// at all of its suite's alternative positions,
+// which may lie anywhere in the header up to the highest level's table.
+func (w *Writer) WriteStream(out io.Writer, rand cipher.Stream) (int, error) {
+	if w.simap == nil {
+		return 0, errors.New("WriteStream called before Layout")
+	}
+	if err := w.checkWrite(rand); err != nil {
+		return 0, err
+	}
+	return out.Write(w.write(rand))
+}
+
+// Finalize and encrypt the negotiation message like Write(),
+// additionally returning the ephemeral Diffie-Hellman public key
+// chosen for each ciphersuite in the header.
+// The caller may use these public keys to derive further shared secrets
+// with the entrypoint owners, e.g., to encrypt the content after the header.
+func (w *Writer) WriteWithKeys(rand cipher.Stream) ([]byte,
+	map[abstract.Suite]abstract.Point, error) {
+	if w.simap == nil {
+		return nil, nil, errors.New("WriteWithKeys called before Layout")
+	}
+	if err := w.checkWrite(rand); err != nil {
+		return nil, nil, err
+	}
+	hdr := w.write(rand)
+	pubs := make(map[abstract.Suite]abstract.Point)
+	for _, si := range w.suites.s {
+		pubs[si.ste] = si.pnt
+	}
+	return hdr, pubs, nil
+}
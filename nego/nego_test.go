@@ -1,10 +1,21 @@
 package nego
 
 import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/cipher/sha3"
 	"github.com/dedis/crypto/random"
+	"github.com/dedis/crypto/test"
 	"github.com/dedis/crypto/edwards"
 )
 
@@ -63,3 +74,2873 @@ func TestNego(t *testing.T) {
 	}
 }
 
+
+// Create n fake ciphersuites derived from a real one,
+// each with a given number of levels, and one entrypoint per suite
+// whose owner's private key is returned in the corresponding slot of privs.
+func testLayoutInputs(n, nlevels, datalen int) (
+	suiteLevel map[abstract.Suite]int, entries []Entry,
+	privs []abstract.Secret) {
+	real := edwards.NewAES128SHA256Ed25519(true)
+	suiteLevel = make(map[abstract.Suite]int)
+	for i := 0; i < n; i++ {
+		s := &fakeSuite{real, i}
+		suiteLevel[s] = nlevels
+		pri, pub := test.GenKeypair(s, random.Stream)
+		data := random.Bytes(datalen, random.Stream)
+		entries = append(entries, Entry{s, pub, data})
+		privs = append(privs, pri)
+	}
+	return
+}
+
+// Decrypt entrypoint i of a header produced by w as its owner would,
+// given the ephemeral public key for its suite and the owner's private key.
+func testOpenEntry(w *Writer, hdr []byte, i int, pub abstract.Point,
+	pri abstract.Secret) []byte {
+	e := &w.entries[i]
+	dhkey := e.Suite.Point().Mul(pub, pri)
+	buf, _ := dhkey.MarshalBinary()
+	lo := w.entofs[i]
+	data := make([]byte, len(w.entryData(e)))
+	e.Suite.Cipher(buf).XORKeyStream(data, hdr[lo:lo+len(data)])
+	return data
+}
+
+func TestAddSuite(t *testing.T) {
+	suiteLevel, entries, _ := testLayoutInputs(5, 8, 16)
+	w := Writer{}
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatal(err)
+	}
+
+	real := edwards.NewAES128SHA256Ed25519(true)
+	s := &fakeSuite{real, 100}
+	if err := w.AddSuite(s, 8); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddSuite(s, 8); err == nil {
+		t.Fatal("AddSuite accepted a suite already laid out")
+	}
+
+	// The new primary position must not overlap any other suite's positions.
+	si := w.simap[s]
+	lo, hi := si.region(si.lev)
+	for _, other := range w.suites.s {
+		if other == si {
+			continue
+		}
+		for j := range other.pos {
+			olo, ohi := other.region(j)
+			if lo < ohi && olo < hi {
+				t.Fatalf("added suite at [%d-%d] overlaps %s at [%d-%d]",
+					lo, hi, other, olo, ohi)
+			}
+		}
+	}
+	w.Write(random.Stream)
+}
+
+// Lay out MockA1 and MockB3 under w's configuration,
+// then add MockC7, whose only free position lies past the end
+// of the header, and MockC0, which has a free position inside it.
+// AddSuite() must refuse MockC7 if the header can't grow,
+// and accept MockC0 without changing the header length.
+// Returns the written header and the levels of the suites laid out.
+func testAddSuiteInside(t *testing.T, w *Writer) ([]byte,
+	map[abstract.Suite]int, map[abstract.Suite]abstract.Point) {
+	a := test.MockSuite("MockA1", 32)
+	b := test.MockSuite("MockB3", 48)
+	suiteLevel := map[abstract.Suite]int{a: 3, b: 2}
+	hdrlen, err := w.Layout(suiteLevel, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddSuite(test.MockSuite("MockC7", 32), 4); err == nil {
+		t.Fatal("AddSuite grew the header")
+	}
+	c := test.MockSuite("MockC0", 32)
+	if err := w.AddSuite(c, 4); err != nil {
+		t.Fatal(err)
+	}
+	suiteLevel[c] = 4
+	hdr, pubs, err := w.WriteWithKeys(random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hdr) != hdrlen {
+		t.Fatalf("header is %d bytes, Layout said %d", len(hdr), hdrlen)
+	}
+	return hdr, suiteLevel, pubs
+}
+
+func TestAddSuiteSuffix(t *testing.T) {
+	w := Writer{}
+	w.SetSuffixLen(8)
+	copy(w.Suffix(), "trailer!")
+	hdr, suiteLevel, pubs := testAddSuiteInside(t, &w)
+	if !bytes.Equal(hdr[len(hdr)-8:], []byte("trailer!")) {
+		t.Fatalf("header ends with %q", hdr[len(hdr)-8:])
+	}
+	for suite, nlevels := range suiteLevel {
+		if !testFindPoint(hdr, suite, nlevels, "").Equal(pubs[suite]) {
+			t.Fatalf("didn't find %s point", suite)
+		}
+	}
+}
+
+func TestAddSuiteHeaderMAC(t *testing.T) {
+	key := []byte("TestAddSuiteHeaderMAC")
+	w := Writer{}
+	w.SetHeaderMAC(key)
+	hdr, suiteLevel, pubs := testAddSuiteInside(t, &w)
+	if !VerifyHeaderMAC(key, hdr) {
+		t.Fatal("header MAC didn't verify")
+	}
+	body := hdr[:len(hdr)-HeaderMACLen]
+	for suite, nlevels := range suiteLevel {
+		if !testFindPoint(body, suite, nlevels, "").Equal(pubs[suite]) {
+			t.Fatalf("didn't find %s point", suite)
+		}
+	}
+}
+
+func TestAddSuiteMaxLen(t *testing.T) {
+	w := Writer{}
+	w.SetMaxLen(200)
+	hdr, suiteLevel, pubs := testAddSuiteInside(t, &w)
+	for suite, nlevels := range suiteLevel {
+		if !testFindPoint(hdr, suite, nlevels, "").Equal(pubs[suite]) {
+			t.Fatalf("didn't find %s point", suite)
+		}
+	}
+
+	// A soft maximum length only gets reported as exceeded.
+	a := test.MockSuite("MockA1", 32)
+	b := test.MockSuite("MockB3", 48)
+	w = Writer{}
+	w.SetMaxLenSoft(200)
+	if _, err := w.Layout(map[abstract.Suite]int{a: 3, b: 2},
+		nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddSuite(test.MockSuite("MockC7", 32), 4); err != nil {
+		t.Fatal(err)
+	}
+	if !w.OverMaxLen() {
+		t.Fatalf("header grew to %d bytes, but OverMaxLen is false",
+			w.hdrlen)
+	}
+}
+
+func TestWriteWithKeys(t *testing.T) {
+	suiteLevel, entries, privs := testLayoutInputs(5, 8, 16)
+	w := Writer{}
+	if _, _, err := w.WriteWithKeys(random.Stream); err == nil {
+		t.Fatal("WriteWithKeys succeeded before Layout")
+	}
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatal(err)
+	}
+	hdr, pubs, err := w.WriteWithKeys(random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pubs) != len(suiteLevel) {
+		t.Fatalf("got %d public keys for %d suites",
+			len(pubs), len(suiteLevel))
+	}
+
+	// Each entrypoint owner must be able to decrypt its entrypoint
+	// using the returned ephemeral public key for its suite.
+	for i := range entries {
+		e := &entries[i]
+		data := testOpenEntry(&w, hdr, i, pubs[e.Suite], privs[i])
+		if !bytes.Equal(data, e.Data) {
+			t.Fatalf("entrypoint %d didn't decrypt correctly", i)
+		}
+	}
+}
+
+func TestSharedKey(t *testing.T) {
+	suiteLevel, entries, privs := testLayoutInputs(5, 8, 16)
+	for i := range entries {
+		entries[i].Data = nil
+	}
+	key := random.Bytes(32, random.Stream)
+	w := Writer{}
+	w.SetSharedKey(key)
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatal(err)
+	}
+	hdr, pubs, err := w.WriteWithKeys(random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range entries {
+		e := &entries[i]
+		data := testOpenEntry(&w, hdr, i, pubs[e.Suite], privs[i])
+		if !bytes.Equal(data, key) {
+			t.Fatalf("entrypoint %d didn't yield the shared key", i)
+		}
+	}
+}
+
+func TestDeriveContentKey(t *testing.T) {
+	suiteLevel, entries, privs := testLayoutInputs(5, 8, 16)
+	w := Writer{}
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatal(err)
+	}
+	hdr, pubs, err := w.WriteWithKeys(random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range entries {
+		e := &entries[i]
+		want := DeriveContentKey(e.Suite.Cipher(abstract.NoKey), e.Data)
+		data := testOpenEntry(&w, hdr, i, pubs[e.Suite], privs[i])
+		key := DeriveContentKey(e.Suite.Cipher(abstract.NoKey), data)
+		if !bytes.Equal(key, want) {
+			t.Fatalf("entrypoint %d yielded the wrong content key", i)
+		}
+		if len(key) != e.Suite.Cipher(abstract.NoKey).KeySize() {
+			t.Fatalf("content key has wrong length %d", len(key))
+		}
+
+		// Different entrypoint data must yield a different key.
+		data[0] ^= 1
+		other := DeriveContentKey(e.Suite.Cipher(abstract.NoKey), data)
+		if bytes.Equal(other, want) {
+			t.Fatalf("content key ignores entrypoint data")
+		}
+	}
+}
+
+func TestSuiteListOrder(t *testing.T) {
+	real := edwards.NewAES128SHA256Ed25519(true)
+	var want []string
+	for run := 0; run < 10; run++ {
+
+		// Suites with equal max must sort the same regardless of input order.
+		var l suiteList
+		for _, i := range []int{3, 1, 4, 0, 2} {
+			si := &suiteInfo{ste: &fakeSuite{real, i}, max: 64}
+			l.s = append(l.s, si)
+		}
+		l.s = append(l.s, &suiteInfo{ste: &fakeSuite{real, 9}, max: 32})
+		for i := range l.s {
+			j := int(random.Uint32(random.Stream) % uint32(i+1))
+			l.s[i], l.s[j] = l.s[j], l.s[i]
+		}
+		sort.Sort(&l)
+
+		var got []string
+		for _, si := range l.s {
+			got = append(got, si.ste.String())
+		}
+		if got[0] != (&fakeSuite{real, 9}).String() {
+			t.Fatalf("suite with lowest max not first: %v", got)
+		}
+		if want == nil {
+			want = got
+		} else if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("unstable suite order: %v vs %v", got, want)
+		}
+	}
+}
+
+func TestLayoutJSON(t *testing.T) {
+	suiteLevel, entries, _ := testLayoutInputs(5, 8, 16)
+	w := Writer{}
+	if _, err := w.LayoutJSON(); err == nil {
+		t.Fatal("LayoutJSON succeeded before Layout")
+	}
+	hdrlen, err := w.Layout(suiteLevel, entries, random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := w.LayoutJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lj layoutJSON
+	if err := json.Unmarshal(buf, &lj); err != nil {
+		t.Fatal(err)
+	}
+	if lj.HdrLen != hdrlen {
+		t.Fatalf("JSON hdrlen %d, Layout returned %d", lj.HdrLen, hdrlen)
+	}
+	if len(lj.Points) != len(suiteLevel) || len(lj.Entries) != len(entries) {
+		t.Fatalf("JSON has %d points and %d entries",
+			len(lj.Points), len(lj.Entries))
+	}
+	for _, p := range lj.Points {
+		if p.Hi > hdrlen || p.Hi-p.Lo != w.suites.s[0].plen {
+			t.Fatalf("bad point reservation %+v", p)
+		}
+	}
+	for i, e := range lj.Entries {
+		if e.Entry != i || e.Suite != entries[i].Suite.String() ||
+			e.Lo != w.entofs[i] || e.Hi-e.Lo != len(entries[i].Data) {
+			t.Fatalf("bad entry reservation %+v", e)
+		}
+	}
+}
+
+func TestEntryData(t *testing.T) {
+	suiteLevel, entries, _ := testLayoutInputs(5, 8, 16)
+	entries[2].Data = []byte{}
+
+	// An entrypoint without data is an error in normal mode...
+	w := Writer{}
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err == nil {
+		t.Fatal("Layout accepted an entrypoint with no data")
+	}
+
+	// ...but not in presence-only mode, where all must lack data.
+	w.SetPresenceOnly(true)
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err == nil {
+		t.Fatal("Layout accepted a presence-only entrypoint with data")
+	}
+	for i := range entries {
+		entries[i].Data = nil
+	}
+	hdrlen, err := w.Layout(suiteLevel, entries, random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr := w.Write(random.Stream); len(hdr) != hdrlen {
+		t.Fatalf("presence-only header is %d bytes, want %d",
+			len(hdr), hdrlen)
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	suiteLevel, entries, _ := testLayoutInputs(10, 8, 16)
+	w := Writer{}
+	hdrlen, err := w.Layout(suiteLevel, entries, random.Stream)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// Use a deterministic stream so results are stable across runs.
+	real := edwards.NewAES128SHA256Ed25519(true)
+	rand := real.Cipher([]byte("BenchmarkWrite"))
+	b.SetBytes(int64(hdrlen))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := range entries {
+			rand.XORKeyStream(entries[j].Data, entries[j].Data)
+		}
+		w.Write(rand)
+	}
+}
+
+func TestDefaultLevels(t *testing.T) {
+	real := edwards.NewAES128SHA256Ed25519(true)
+	suites := []abstract.Suite{&fakeSuite{real, 0}, &fakeSuite{real, 1}}
+	for _, c := range []struct{ maxSuites, level int }{
+		{1, 1}, {2, 1}, {3, 2}, {255, 8}, {256, 8}, {257, 9},
+	} {
+		suiteLevel := DefaultLevels(suites, c.maxSuites)
+		if len(suiteLevel) != len(suites) {
+			t.Fatalf("got %d levels for %d suites",
+				len(suiteLevel), len(suites))
+		}
+		for _, s := range suites {
+			if suiteLevel[s] != c.level {
+				t.Fatalf("maxSuites %d: level %d, want %d",
+					c.maxSuites, suiteLevel[s], c.level)
+			}
+		}
+	}
+}
+
+func TestLevelsFor(t *testing.T) {
+	for _, c := range []struct{ maxSuites, levels int }{
+		{-1, 1}, {0, 1}, {1, 1}, {2, 1}, {3, 2}, {4, 2}, {5, 3},
+		{255, 8}, {256, 8}, {257, 9},
+	} {
+		if l := LevelsFor(c.maxSuites); l != c.levels {
+			t.Fatalf("LevelsFor(%d) = %d, want %d",
+				c.maxSuites, l, c.levels)
+		}
+	}
+
+	// The level tables then hold 2^levels-1 positions in total,
+	// enough for every suite but the one at position 0,
+	// and the top level alone has room for half the suites.
+	suite := test.MockSuite("Mock", 32)
+	for n := 2; n <= 300; n++ {
+		levels := LevelsFor(n)
+		var si suiteInfo
+		if err := si.init(suite, levels, "", nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		slots := 1<<uint(levels) - 1
+		if si.max > slots*si.plen {
+			t.Fatalf("%d suites: positions extend to %d, past %d "+
+				"tables", n, si.max, levels)
+		}
+		if slots < n-1 || 2<<uint(levels-1) < n {
+			t.Fatalf("%d suites: %d levels too few", n, levels)
+		}
+	}
+}
+
+// Count the fraction of 1 bits in a byte-slice.
+func testOnesFraction(b []byte) float64 {
+	ones := 0
+	for _, v := range b {
+		for ; v != 0; v &= v - 1 {
+			ones++
+		}
+	}
+	return float64(ones) / float64(len(b)*8)
+}
+
+// Check that the bytes Write fills randomly are statistically
+// indistinguishable from the reserved point and entrypoint regions,
+// so that an observer can't segment the header.
+func fillIndistinguishabilityTest(t *testing.T,
+	suiteLevel map[abstract.Suite]int, entries []Entry) {
+	w := Writer{}
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatal(err)
+	}
+	hdr1 := append([]byte{}, w.Write(random.Stream)...)
+	hdr2 := append([]byte{}, w.Write(random.Stream)...)
+	if len(hdr1) != len(hdr2) {
+		t.Fatalf("header lengths differ: %d, %d", len(hdr1), len(hdr2))
+	}
+
+	// Separate the fill bytes from the reserved bytes.
+	var fill1, fill2, rsvd []byte
+	ofs := 0
+	w.layout.scanFree(func(lo, hi int) {
+		rsvd = append(rsvd, hdr1[ofs:lo]...)
+		fill1 = append(fill1, hdr1[lo:hi]...)
+		fill2 = append(fill2, hdr2[lo:hi]...)
+		ofs = hi
+	}, len(hdr1))
+	rsvd = append(rsvd, hdr1[ofs:]...)
+	if len(fill1) < 256 || len(rsvd) < 256 {
+		t.Fatalf("too few fill (%d) or reserved (%d) bytes to test",
+			len(fill1), len(rsvd))
+	}
+
+	if d := test.BitDiff(fill1, fill2); d < 0.45 || d > 0.55 {
+		t.Fatalf("fill of two headers differs in %f of bits", d)
+	}
+	zeros := 0
+	for _, b := range fill1 {
+		if b == 0 {
+			zeros++
+		}
+	}
+	if zeros > len(fill1)/32 {
+		t.Fatalf("%d of %d fill bytes are zero", zeros, len(fill1))
+	}
+	fo, ro := testOnesFraction(fill1), testOnesFraction(rsvd)
+	if fo < 0.45 || fo > 0.55 || ro < 0.45 || ro > 0.55 {
+		t.Fatalf("bit density of fill %f vs reserved %f", fo, ro)
+	}
+}
+
+func TestFillIndistinguishability(t *testing.T) {
+	suiteLevel, entries, _ := testLayoutInputs(10, 8, 64)
+	fillIndistinguishabilityTest(t, suiteLevel, entries)
+}
+
+func TestMarshalLayout(t *testing.T) {
+	suiteLevel, entries, privs := testLayoutInputs(5, 8, 16)
+	w1 := Writer{}
+	if _, err := w1.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := w1.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w2 := Writer{}
+	if err := w2.UnmarshalBinary(buf); err == nil {
+		t.Fatal("UnmarshalBinary succeeded before SetInputs")
+	}
+	w2.SetInputs(suiteLevel, entries)
+	if err := w2.UnmarshalBinary(buf[:len(buf)-1]); err == nil {
+		t.Fatal("UnmarshalBinary accepted a truncated layout")
+	}
+	w2.SetInputs(suiteLevel, entries)
+	if err := w2.UnmarshalBinary(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	j1, _ := w1.LayoutJSON()
+	j2, _ := w2.LayoutJSON()
+	if !bytes.Equal(j1, j2) {
+		t.Fatalf("restored layout differs:\n%s\n%s", j1, j2)
+	}
+	hdr, pubs, err := w2.WriteWithKeys(random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range entries {
+		e := &entries[i]
+		data := testOpenEntry(&w2, hdr, i, pubs[e.Suite], privs[i])
+		if !bytes.Equal(data, e.Data) {
+			t.Fatalf("entrypoint %d didn't decrypt correctly", i)
+		}
+	}
+
+	// Tampered layouts are rejected rather than producing bad headers.
+	tampers := map[string]func(c *Writer){
+		"wrong point length": func(c *Writer) {
+			c.suites.s[0].plen = 7
+		},
+		"short header": func(c *Writer) {
+			c.hdrlen = 10
+		},
+		"huge header": func(c *Writer) {
+			c.hdrlen = 1 << 30
+		},
+		"duplicate suite": func(c *Writer) {
+			c.suites.s[1] = c.suites.s[0]
+		},
+		"unordered positions": func(c *Writer) {
+			pos := c.suites.s[0].pos
+			pos[1], pos[2] = pos[2], pos[1]
+		},
+		"entrypoint past header": func(c *Writer) {
+			c.entofs[0] = c.hdrlen
+		},
+	}
+	for name, tamper := range tampers {
+		c := w1.Clone()
+		tamper(c)
+		bad, err := c.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w3 := Writer{}
+		w3.SetInputs(suiteLevel, entries)
+		if err := w3.UnmarshalBinary(bad); err == nil {
+			t.Fatalf("UnmarshalBinary accepted layout with %s", name)
+		}
+	}
+}
+
+func TestLayoutStress(t *testing.T) {
+	real := edwards.NewAES128SHA256Ed25519(true)
+	rand := real.Cipher([]byte("TestLayoutStress"))
+	pick := func(n int) int {
+		return int(random.Uint32(rand) % uint32(n))
+	}
+	plens := []int{8, 16, 32, 48}
+	for trial := 0; trial < 200; trial++ {
+		suiteLevel := make(map[abstract.Suite]int)
+		nsuites := 1 + pick(20)
+		for i := 0; i < nsuites; i++ {
+			name := fmt.Sprintf("Mock%d.%d", trial, i)
+			s := test.MockSuite(name, plens[pick(len(plens))])
+			suiteLevel[s] = 1 + pick(10)
+		}
+
+		w := Writer{}
+		func() {
+			defer func() {
+				if e := recover(); e != nil {
+					t.Fatalf("trial %d: Layout panicked: %v", trial, e)
+				}
+			}()
+			if _, err := w.Layout(suiteLevel, nil, rand); err != nil {
+				return // failing cleanly is fine
+			}
+			for _, si := range w.suites.s {
+				lo, hi := si.region(si.lev)
+				for _, sj := range w.suites.s {
+					if si == sj {
+						continue
+					}
+					olo, ohi := sj.region(sj.lev)
+					if lo < ohi && olo < hi {
+						t.Fatalf("trial %d: %s and %s overlap",
+							trial, si, sj)
+					}
+				}
+			}
+		}()
+	}
+}
+
+// Create mock ciphersuites with a given hiding-encoded point length,
+// one entrypoint per suite whose owner's private key is returned in privs.
+func testMockInputs(n, nlevels, plen, datalen int) (
+	suiteLevel map[abstract.Suite]int, entries []Entry,
+	privs []abstract.Secret) {
+	suiteLevel = make(map[abstract.Suite]int)
+	for i := 0; i < n; i++ {
+		s := test.MockSuite(fmt.Sprintf("Mock%d", i), plen)
+		suiteLevel[s] = nlevels
+		pri, pub := test.GenKeypair(s, random.Stream)
+		data := random.Bytes(datalen, random.Stream)
+		entries = append(entries, Entry{s, pub, data})
+		privs = append(privs, pri)
+	}
+	return
+}
+
+func TestSetMaxLen(t *testing.T) {
+	suiteLevel, entries, _ := testMockInputs(5, 8, 32, 16)
+	w := Writer{}
+	hdrlen, err := w.Layout(suiteLevel, entries, random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr := w.Write(random.Stream); len(hdr) != hdrlen {
+		t.Fatalf("header is %d bytes, Layout said %d", len(hdr), hdrlen)
+	}
+
+	// A larger maximum has no effect.
+	w.SetMaxLen(hdrlen * 2)
+	if l, err := w.Layout(suiteLevel, entries, random.Stream); err != nil ||
+		l != hdrlen {
+		t.Fatalf("with larger max: hdrlen %d, err %v", l, err)
+	}
+
+	// A maximum of exactly the header length still fits.
+	w.SetMaxLen(hdrlen)
+	if l, err := w.Layout(suiteLevel, entries, random.Stream); err != nil ||
+		l != hdrlen {
+		t.Fatalf("with exact max: hdrlen %d, err %v", l, err)
+	}
+	if hdr := w.Write(random.Stream); len(hdr) > hdrlen {
+		t.Fatalf("header is %d bytes, max %d", len(hdr), hdrlen)
+	}
+
+	// Too small a maximum to fit even the points must fail.
+	w.SetMaxLen(32*len(suiteLevel) - 1)
+	if _, err := w.Layout(suiteLevel, nil, random.Stream); err == nil {
+		t.Fatal("Layout fit points into too small a maximum")
+	}
+
+	// Too small a maximum to fit the entrypoints must fail too.
+	w.SetMaxLen(0)
+	ptlen, err := w.Layout(suiteLevel, nil, random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetMaxLen(ptlen)
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err == nil &&
+		ptlen < hdrlen {
+		t.Fatal("Layout fit entrypoints into too small a maximum")
+	}
+}
+
+func TestSetMaxLenSoft(t *testing.T) {
+	suiteLevel, entries, privs := testMockInputs(5, 8, 32, 16)
+	w := Writer{}
+	hdrlen, err := w.Layout(suiteLevel, entries, random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Within the limit, a soft maximum acts like a hard one.
+	w.SetMaxLenSoft(hdrlen)
+	if l, err := w.Layout(suiteLevel, entries, random.Stream); err != nil ||
+		l != hdrlen || w.OverMaxLen() {
+		t.Fatalf("within soft max: hdrlen %d, err %v, over %v",
+			l, err, w.OverMaxLen())
+	}
+
+	// Past the limit, Layout exceeds it rather than failing.
+	w.SetMaxLen(hdrlen - 1)
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err == nil {
+		t.Fatal("Layout fit a header into too small a maximum")
+	}
+	w.SetMaxLenSoft(hdrlen - 1)
+	l, err := w.Layout(suiteLevel, entries, random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !w.OverMaxLen() || l <= hdrlen-1 {
+		t.Fatalf("over soft max: hdrlen %d, over %v", l, w.OverMaxLen())
+	}
+	if !w.CanFit(suiteLevel, 16, len(entries)) {
+		t.Fatal("CanFit rejected a layout under a soft maximum")
+	}
+
+	// The oversized header still works.
+	hdr, pubs, err := w.WriteWithKeys(random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hdr) != l {
+		t.Fatalf("header is %d bytes, Layout said %d", len(hdr), l)
+	}
+	for i := range entries {
+		e := &entries[i]
+		data := testOpenEntry(&w, hdr, i, pubs[e.Suite], privs[i])
+		if !bytes.Equal(data, e.Data) {
+			t.Fatalf("entrypoint %d corrupted", i)
+		}
+	}
+
+	// SetMaxLen makes the limit hard again.
+	w.SetMaxLen(hdrlen - 1)
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err == nil {
+		t.Fatal("SetMaxLen didn't restore a hard maximum")
+	}
+	if w.OverMaxLen() {
+		t.Fatal("OverMaxLen set by a failed hard layout")
+	}
+}
+
+func TestSuiteInitPositions(t *testing.T) {
+	real := edwards.NewAES128SHA256Ed25519(true)
+	for _, nlevels := range []int{1, 4, 8, 16} {
+		for i := 0; i < 10; i++ {
+			var si suiteInfo
+			err := si.init(&fakeSuite{real, i}, nlevels, "", nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if si.pos[0] != 0 {
+				t.Fatalf("level 0 position is %d, not 0", si.pos[0])
+			}
+			for j := 1; j < nlevels; j++ {
+				if si.pos[j] < si.pos[j-1]+si.plen {
+					t.Fatalf("%s level %d position %d overlaps "+
+						"level %d position %d", si.ste, j,
+						si.pos[j], j-1, si.pos[j-1])
+				}
+			}
+			if si.max != si.pos[nlevels-1]+si.plen {
+				t.Fatalf("%s max %d, want %d", si.ste, si.max,
+					si.pos[nlevels-1]+si.plen)
+			}
+		}
+	}
+}
+
+// Check that a suite's positions stay distinct across levels
+// even when tags at different levels select the same alternative index,
+// which is common with few alternatives per level.
+func TestSuitePositionsDistinct(t *testing.T) {
+	suite := test.MockSuite("Mock", 8)
+	nlevels := 8
+	sameidx := 0
+	for d := 0; d < 100; d++ {
+		var si suiteInfo
+		domain := fmt.Sprintf("Domain%d:", d)
+		if err := si.init(suite, nlevels, domain, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		seen := make(map[int]int)
+		idxs := make(map[int]bool)
+		for i := 0; i < nlevels; i++ {
+			if j, ok := seen[si.pos[i]]; ok {
+				t.Fatalf("domain %d: levels %d and %d "+
+					"share position %d", d, j, i, si.pos[i])
+			}
+			seen[si.pos[i]] = i
+			idx := int(si.tag[i]) & (1<<uint(i) - 1)
+			if idxs[idx] {
+				sameidx++
+			}
+			idxs[idx] = true
+		}
+	}
+	if sameidx == 0 {
+		t.Fatal("no tags selected the same index at two levels")
+	}
+}
+
+// Check that distinct suite names seed decorrelated position streams:
+// the suites' tag arrays must be pairwise distinct at every level,
+// and differ in about half their bits.
+// Suites with identical names get identical positions by design,
+// which is why Layout rejects them.
+func testSeedUniqueness(t *testing.T, suites []abstract.Suite) {
+	nlevels := 16
+	tags := make([][]byte, len(suites))
+	for i, suite := range suites {
+		var si suiteInfo
+		if err := si.init(suite, nlevels, "", nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		tags[i] = make([]byte, 4*nlevels)
+		for j, tag := range si.tag {
+			binary.BigEndian.PutUint32(tags[i][4*j:], tag)
+		}
+	}
+	for i := range suites {
+		for j := i + 1; j < len(suites); j++ {
+			for k := 0; k < nlevels; k++ {
+				a := tags[i][4*k : 4*k+4]
+				b := tags[j][4*k : 4*k+4]
+				if bytes.Equal(a, b) {
+					t.Fatalf("%s and %s share level %d tag",
+						suites[i], suites[j], k)
+				}
+			}
+			d := test.BitDiff(tags[i], tags[j])
+			if d < 0.35 || d > 0.65 {
+				t.Fatalf("%s and %s tags differ in %v of their bits",
+					suites[i], suites[j], d)
+			}
+		}
+	}
+}
+
+func TestSeedUniqueness(t *testing.T) {
+	var suites []abstract.Suite
+	for _, name := range []string{"Mock", "Mock1", "Mock12", "Mock2",
+		"Moc", "ock", "mock", "Mock ", " Mock", "Mock\x00"} {
+		suites = append(suites, test.MockSuite(name, 32))
+	}
+	real := edwards.NewAES128SHA256Ed25519(true)
+	for i := 0; i < 4; i++ {
+		suites = append(suites, &fakeSuite{real, i})
+	}
+	testSeedUniqueness(t, suites)
+}
+
+func benchmarkSuiteInit(b *testing.B, nlevels int) {
+	suite := edwards.NewAES128SHA256Ed25519(true)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var si suiteInfo
+		si.init(suite, nlevels, "", nil, nil)
+	}
+}
+
+func BenchmarkSuiteInit4(b *testing.B)  { benchmarkSuiteInit(b, 4) }
+func BenchmarkSuiteInit8(b *testing.B)  { benchmarkSuiteInit(b, 8) }
+func BenchmarkSuiteInit16(b *testing.B) { benchmarkSuiteInit(b, 16) }
+
+func TestSuiteCache(t *testing.T) {
+	SetSuiteCacheSize(4)
+	defer SetSuiteCacheSize(0)
+
+	var suites []abstract.Suite
+	var want [][]int
+	for i := 0; i < 10; i++ {
+		suite := test.MockSuite(fmt.Sprintf("Mock%d", i), 32)
+		suites = append(suites, suite)
+		var si suiteInfo
+		si.init(suite, 8, "", nil, nil)
+		want = append(want, append([]int(nil), si.pos...))
+		if positions.len() > 4 {
+			t.Fatalf("cache holds %d suites, limit 4", positions.len())
+		}
+	}
+
+	// The most recently used suites are cached; the rest were evicted.
+	for i, suite := range suites {
+		key := posKey{suite, 8, "", binary.BigEndian.String()}
+		var si suiteInfo
+		si.tag = make([]uint32, 8)
+		si.pos = make([]int, 8)
+		if hit := positions.get(key, &si); hit != (i >= 6) {
+			t.Fatalf("suite %d cached: %v", i, hit)
+		}
+	}
+
+	// Cached or not, positions are the same as derived afresh,
+	// including concurrently with eviction.
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				j := (i * 7) % len(suites)
+				var si suiteInfo
+				si.init(suites[j], 8, "", nil, nil)
+				for k := range si.pos {
+					if si.pos[k] != want[j][k] {
+						t.Errorf("suite %d level %d at %d, want %d",
+							j, k, si.pos[k], want[j][k])
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	SetSuiteCacheSize(0)
+	if positions.len() != 0 {
+		t.Fatal("disabling the cache left suites cached")
+	}
+}
+
+func TestFixedSuiteSet(t *testing.T) {
+	var fixed []abstract.Suite
+	var entries []Entry
+	for i, plen := range []int{8, 16, 32, 48, 64, 96} {
+		s := test.MockSuite(fmt.Sprintf("Mock%d", i), plen)
+		pub := s.Point().Mul(nil, s.Secret().Pick(random.Stream))
+		data := random.Bytes(16, random.Stream)
+		fixed = append(fixed, s)
+		entries = append(entries, Entry{s, pub, data})
+	}
+
+	// Lay out headers for two different subsets of the suites,
+	// with the same number of recipients in each,
+	// leaving all suites at their default levels.
+	layout := func(sel []int) (int, string) {
+		var ents []Entry
+		for _, i := range sel {
+			ents = append(ents, entries[i], entries[i])
+		}
+		w := Writer{}
+		w.SetFixedSuiteSet(fixed)
+		hdrlen, err := w.Layout(nil, ents, random.Stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(w.suites.s) != len(fixed) {
+			t.Fatalf("laid out %d suites, not %d",
+				len(w.suites.s), len(fixed))
+		}
+		if hdr := w.Write(random.Stream); len(hdr) != hdrlen {
+			t.Fatalf("header is %d bytes, Layout said %d",
+				len(hdr), hdrlen)
+		}
+		var pts []pointJSON
+		for _, si := range w.suites.s {
+			lo, hi := si.region(si.lev)
+			pts = append(pts, pointJSON{si.ste.String(), si.lev, lo, hi})
+		}
+		return hdrlen, fmt.Sprint(pts)
+	}
+	len1, pts1 := layout([]int{0, 1, 2})
+	len2, pts2 := layout([]int{3, 5, 4})
+	if len1 != len2 {
+		t.Fatalf("header lengths %d and %d differ", len1, len2)
+	}
+	if pts1 != pts2 {
+		t.Fatalf("point layouts differ:\n%s\n%s", pts1, pts2)
+	}
+}
+
+func TestZeroLevel(t *testing.T) {
+	suiteLevel, entries, _ := testMockInputs(3, 8, 32, 16)
+	bad := test.MockSuite("MockBad", 32)
+	for _, lev := range []int{0, -1} {
+		suiteLevel[bad] = lev
+		w := Writer{}
+		_, err := w.Layout(suiteLevel, entries, random.Stream)
+		if err == nil {
+			t.Fatalf("Layout accepted level %d", lev)
+		}
+		if !strings.Contains(err.Error(), "MockBad") {
+			t.Fatalf("error doesn't name the suite: %v", err)
+		}
+	}
+
+	delete(suiteLevel, bad)
+	w := Writer{}
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddSuite(bad, 0); err == nil {
+		t.Fatal("AddSuite accepted level 0")
+	}
+}
+
+// Suite whose points have a hiding encoding of a given length.
+type testHideLenSuite struct {
+	abstract.Suite
+	hidelen int
+}
+
+type testHideLenPoint struct {
+	abstract.Point
+	hidelen int
+}
+
+func (s *testHideLenSuite) Point() abstract.Point {
+	return &testHideLenPoint{s.Suite.Point(), s.hidelen}
+}
+
+func (p *testHideLenPoint) HideLen() int { return p.hidelen }
+
+func (p *testHideLenPoint) HideEncode(rand cipher.Stream) []byte {
+	return p.Point.(abstract.Hiding).HideEncode(rand)[:p.hidelen]
+}
+
+func (p *testHideLenPoint) HideDecode(buf []byte) {}
+
+// Suite whose points have no hiding encoding.
+type testNoHideSuite struct {
+	abstract.Suite
+}
+
+func (s *testNoHideSuite) Point() abstract.Point {
+	return struct{ abstract.Point }{s.Suite.Point()}
+}
+
+func TestSuiteInitErrors(t *testing.T) {
+	mock := test.MockSuite("Mock", 32)
+	for _, c := range []struct {
+		suite   abstract.Suite
+		nlevels int
+		err     string
+	}{
+		{mock, 0, "level less than 1"},
+		{&testNoHideSuite{mock}, 8, "no hiding point encoding"},
+		{&testHideLenSuite{mock, 0}, 8, "empty hiding point encoding"},
+	} {
+		var si suiteInfo
+		err := si.init(c.suite, c.nlevels, "", nil, nil)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("init error %v, want %q", err, c.err)
+		}
+
+		// Layout and AddSuite report the same errors.
+		suiteLevel, entries, _ := testMockInputs(3, 8, 32, 16)
+		suiteLevel[c.suite] = c.nlevels
+		w := Writer{}
+		_, err = w.Layout(suiteLevel, entries, random.Stream)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("Layout error %v, want %q", err, c.err)
+		}
+		delete(suiteLevel, c.suite)
+		if _, err := w.Layout(suiteLevel, entries, nil); err != nil {
+			t.Fatal(err)
+		}
+		err = w.AddSuite(c.suite, c.nlevels)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("AddSuite error %v, want %q", err, c.err)
+		}
+	}
+}
+
+func TestSuffix(t *testing.T) {
+	suiteLevel, entries, _ := testMockInputs(5, 8, 32, 16)
+	w := Writer{}
+	plain, err := w.Layout(suiteLevel, entries, random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.SetSuffixLen(20)
+	hdrlen, err := w.Layout(suiteLevel, entries, random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdrlen != plain+20 {
+		t.Fatalf("hdrlen %d with suffix, %d without", hdrlen, plain)
+	}
+	suffix := []byte("protocol trailer 1.0")
+	copy(w.Suffix(), suffix)
+	for i := 0; i < 3; i++ {
+		hdr := w.Write(random.Stream)
+		if len(hdr) != hdrlen {
+			t.Fatalf("header is %d bytes, Layout said %d",
+				len(hdr), hdrlen)
+		}
+		if !bytes.Equal(hdr[hdrlen-20:], suffix) {
+			t.Fatalf("header ends with %q", hdr[hdrlen-20:])
+		}
+	}
+
+	// The suffix must still fit within the maximum length.
+	w.SetMaxLen(hdrlen - 1)
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err == nil {
+		t.Fatal("Layout fit suffix into too small a maximum")
+	}
+
+	// A negative length means no suffix.
+	w.SetMaxLen(0)
+	w.SetSuffixLen(-1)
+	if hdrlen, err := w.Layout(suiteLevel, entries,
+		random.Stream); err != nil || hdrlen != plain {
+		t.Fatalf("hdrlen %d with negative suffix length, want %d: %v",
+			hdrlen, plain, err)
+	}
+}
+
+func TestFillBytes(t *testing.T) {
+	suiteLevel, entries, _ := testMockInputs(5, 8, 32, 16)
+	w := Writer{}
+	hdrlen, err := w.Layout(suiteLevel, entries, random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	used := 5*32 + len(entries)*16
+	if fill := w.FillBytes(); fill != hdrlen-used {
+		t.Fatalf("FillBytes %d, want %d - %d", fill, hdrlen, used)
+	}
+
+	// A lone suite at level 0 with no entrypoints leaves nothing to fill.
+	w = Writer{}
+	s := test.MockSuite("Mock", 32)
+	suiteLevel = map[abstract.Suite]int{s: 1}
+	if _, err := w.Layout(suiteLevel, nil, random.Stream); err != nil {
+		t.Fatal(err)
+	}
+	if fill := w.FillBytes(); fill != 0 {
+		t.Fatalf("FillBytes %d for a single point", fill)
+	}
+}
+
+func TestSingleLevel(t *testing.T) {
+	suiteLevel, entries, privs := testMockInputs(1, 8, 32, 16)
+	e := entries[0]
+	entries = append(entries, Entry{e.Suite, e.PubKey, []byte("second")})
+	privs = append(privs, privs[0])
+
+	w := Writer{}
+	w.SetSingleLevel(true)
+	hdrlen, err := w.Layout(suiteLevel, entries, random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdrlen != 32+16+6 {
+		t.Fatalf("hdrlen %d, not sequentially packed", hdrlen)
+	}
+	if w.entofs[0] != 32 || w.entofs[1] != 48 {
+		t.Fatalf("entrypoints at %d and %d", w.entofs[0], w.entofs[1])
+	}
+	hdr, pubs, err := w.WriteWithKeys(random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range entries {
+		data := testOpenEntry(&w, hdr, i, pubs[e.Suite], privs[i])
+		if !bytes.Equal(data, entries[i].Data) {
+			t.Fatalf("entrypoint %d didn't decrypt", i)
+		}
+	}
+
+	if err := w.AddSuite(test.MockSuite("Other", 32), 8); err == nil {
+		t.Fatal("AddSuite accepted a second suite in single-level mode")
+	}
+	suiteLevel[test.MockSuite("Other", 32)] = 8
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err == nil {
+		t.Fatal("Layout accepted two suites in single-level mode")
+	}
+}
+
+// Recover a suite's ephemeral public key from a header as a reader would,
+// by XORing together all of the suite's point positions within the header.
+func testFindPoint(hdr []byte, suite abstract.Suite, nlevels int,
+	domain string) abstract.Point {
+	return testFindPointOrder(hdr, suite, nlevels, domain, nil)
+}
+
+func testFindPointOrder(hdr []byte, suite abstract.Suite, nlevels int,
+	domain string, order binary.ByteOrder) abstract.Point {
+	var si suiteInfo
+	si.init(suite, nlevels, domain, order, nil)
+	buf := make([]byte, si.plen)
+	for j := range si.pos {
+		lo, hi := si.region(j)
+		if hi <= len(hdr) {
+			for k := range buf {
+				buf[k] ^= hdr[lo+k]
+			}
+		}
+	}
+	pnt := suite.Point()
+	pnt.(abstract.Hiding).HideDecode(buf)
+	return pnt
+}
+
+func TestPositionDomain(t *testing.T) {
+	suiteLevel, entries, _ := testMockInputs(5, 8, 32, 16)
+	for _, domain := range []string{"", "v2:"} {
+		w := Writer{}
+		w.SetPositionDomain(domain)
+		if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+			t.Fatal(err)
+		}
+		hdr, pubs, err := w.WriteWithKeys(random.Stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other := "v2:"
+		if domain == other {
+			other = ""
+		}
+		for suite, nlevels := range suiteLevel {
+			pnt := testFindPoint(hdr, suite, nlevels, domain)
+			if !pnt.Equal(pubs[suite]) {
+				t.Fatalf("domain %q: didn't find %s point",
+					domain, suite)
+			}
+			pnt = testFindPoint(hdr, suite, nlevels, other)
+			if pnt.Equal(pubs[suite]) {
+				t.Fatalf("domain %q: found %s point with domain %q",
+					domain, suite, other)
+			}
+		}
+	}
+}
+
+func TestSuitePositions(t *testing.T) {
+	// Golden positions: changing these breaks interoperability
+	// with every Reader deriving positions the same way.
+	want := []int{0, 32, 96, 224, 576, 1536}
+	got := SuitePositions(test.MockSuite("Mock", 32), len(want))
+	if len(got) != len(want) {
+		t.Fatalf("got %d positions, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("positions %v, want %v", got, want)
+		}
+	}
+
+	// Layout derives the same positions.
+	suite := test.MockSuite("Mock", 32)
+	w := Writer{}
+	suiteLevel := map[abstract.Suite]int{suite: len(want)}
+	if _, err := w.Layout(suiteLevel, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i, pos := range w.simap[suite].pos {
+		if pos != want[i] {
+			t.Fatalf("Layout put level %d at %d, want %d",
+				i, pos, want[i])
+		}
+	}
+
+	if SuitePositions(suite, 0) != nil {
+		t.Fatal("SuitePositions accepted a level less than 1")
+	}
+}
+
+// Recover a suite's point from a header given its table of positions.
+func testFindPointAt(hdr []byte, suite abstract.Suite,
+	positions []int) abstract.Point {
+	plen := suite.Point().(abstract.Hiding).HideLen()
+	buf := make([]byte, plen)
+	for _, lo := range positions {
+		if lo+plen <= len(hdr) {
+			for k := range buf {
+				buf[k] ^= hdr[lo+k]
+			}
+		}
+	}
+	pnt := suite.Point()
+	pnt.(abstract.Hiding).HideDecode(buf)
+	return pnt
+}
+
+func TestSetSuitePositions(t *testing.T) {
+	suiteLevel, entries, privs := testMockInputs(3, 6, 32, 16)
+	fixed := entries[0].Suite
+	table := []int{40, 72, 200, 424, 1000}
+	w := Writer{}
+	w.SetSuitePositions(fixed, table)
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatal(err)
+	}
+	si := w.simap[fixed]
+	if len(si.pos) != len(table) {
+		t.Fatalf("%d levels, want %d", len(si.pos), len(table))
+	}
+	for i := range table {
+		if si.pos[i] != table[i] {
+			t.Fatalf("positions %v, want %v", si.pos, table)
+		}
+	}
+
+	// Readers find the point using the same table,
+	// and the other suites' points where they derive them.
+	hdr, pubs, err := w.WriteWithKeys(random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !testFindPointAt(hdr, fixed, table).Equal(pubs[fixed]) {
+		t.Fatal("point not found at the fixed positions")
+	}
+	for suite, nlevels := range suiteLevel {
+		if suite != fixed &&
+			!testFindPoint(hdr, suite, nlevels, "").Equal(pubs[suite]) {
+			t.Fatalf("didn't find %s point", suite)
+		}
+	}
+	for i := range entries {
+		e := &entries[i]
+		data := testOpenEntry(&w, hdr, i, pubs[e.Suite], privs[i])
+		if !bytes.Equal(data, e.Data) {
+			t.Fatalf("entrypoint %d corrupted", i)
+		}
+	}
+
+	// Bad tables make Layout fail.
+	for _, bad := range [][]int{{}, {-32}, {0, 16}, {64, 0}} {
+		w := Writer{}
+		w.SetSuitePositions(fixed, bad)
+		if _, err := w.Layout(suiteLevel, nil, nil); err == nil {
+			t.Fatalf("Layout accepted fixed positions %v", bad)
+		}
+	}
+
+	// Nil positions restore derivation.
+	w.SetSuitePositions(fixed, nil)
+	if _, err := w.Layout(suiteLevel, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := SuitePositions(fixed, suiteLevel[fixed])
+	for i, pos := range w.simap[fixed].pos {
+		if pos != want[i] {
+			t.Fatalf("positions %v, want derived %v",
+				w.simap[fixed].pos, want)
+		}
+	}
+}
+
+func TestTagEndianness(t *testing.T) {
+	suite := test.MockSuite("Mock", 32)
+	var big, little suiteInfo
+	if err := big.init(suite, 8, "", binary.BigEndian, nil); err != nil {
+		t.Fatal(err)
+	}
+	err := little.init(suite, 8, "", binary.LittleEndian, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var def suiteInfo
+	if err := def.init(suite, 8, "", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := range big.pos {
+		if def.pos[i] != big.pos[i] {
+			t.Fatal("default tag byte order isn't big-endian")
+		}
+	}
+	differ := false
+	for i := range big.pos {
+		if big.tag[i] != little.tag[i] {
+			differ = true
+		}
+	}
+	if !differ {
+		t.Fatal("byte order doesn't affect position tags")
+	}
+
+	// A reader using the writer's byte order finds the points,
+	// and one using the other byte order doesn't.
+	suiteLevel, entries, _ := testMockInputs(5, 8, 32, 16)
+	w := Writer{}
+	w.SetTagEndianness(binary.LittleEndian)
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatal(err)
+	}
+	hdr, pubs, err := w.WriteWithKeys(random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for suite, nlevels := range suiteLevel {
+		pnt := testFindPointOrder(hdr, suite, nlevels, "",
+			binary.LittleEndian)
+		if !pnt.Equal(pubs[suite]) {
+			t.Fatalf("didn't find %s point", suite)
+		}
+		pnt = testFindPointOrder(hdr, suite, nlevels, "", nil)
+		if pnt.Equal(pubs[suite]) {
+			t.Fatalf("found %s point with big-endian tags", suite)
+		}
+	}
+}
+
+// Suite identical to another but for its symmetric Cipher.
+type testShakeSuite struct {
+	abstract.Suite
+}
+
+func (s *testShakeSuite) Cipher(key []byte,
+	options ...interface{}) abstract.Cipher {
+	return sha3.NewShakeCipher256(key, options...)
+}
+
+func TestPositionHash(t *testing.T) {
+	mock := test.MockSuite("Mock", 32)
+	shake := &testShakeSuite{mock}
+	fixed := func(seed []byte) cipher.Stream {
+		return sha3.NewShakeCipher128(seed)
+	}
+
+	// By default positions depend on each suite's own Cipher.
+	var a, b suiteInfo
+	a.init(mock, 16, "", nil, nil)
+	b.init(shake, 16, "", nil, nil)
+	same := true
+	for i := range a.pos {
+		same = same && a.pos[i] == b.pos[i]
+	}
+	if same {
+		t.Fatal("suites with different Ciphers share all positions")
+	}
+
+	// With a fixed hash, they share all positions.
+	a.init(mock, 16, "", nil, fixed)
+	b.init(shake, 16, "", nil, fixed)
+	for i := range a.pos {
+		if a.pos[i] != b.pos[i] {
+			t.Fatalf("level %d: positions %d and %d differ "+
+				"under a fixed hash", i, a.pos[i], b.pos[i])
+		}
+	}
+
+	// Layout derives the same positions under the fixed hash.
+	for _, suite := range []abstract.Suite{mock, shake} {
+		_, pub := test.GenKeypair(suite, random.Stream)
+		suiteLevel := map[abstract.Suite]int{suite: 16}
+		entries := []Entry{{suite, pub, []byte("data")}}
+		w := Writer{}
+		w.SetPositionHash(fixed)
+		if _, err := w.Layout(suiteLevel, entries, nil); err != nil {
+			t.Fatal(err)
+		}
+		si := w.simap[suite]
+		for i := range si.pos {
+			if si.pos[i] != a.pos[i] {
+				t.Fatalf("%s: level %d at offset %d, want %d",
+					suite, i, si.pos[i], a.pos[i])
+			}
+		}
+	}
+}
+
+// Decrypt an entrypoint laid out with SetEntryMACLen(maclen),
+// returning its data and whether its MAC checks out.
+func testOpenEntryMAC(w *Writer, hdr []byte, i int, pub abstract.Point,
+	pri abstract.Secret, maclen int) ([]byte, bool) {
+	e := &w.entries[i]
+	dhkey := e.Suite.Point().Mul(pub, pri)
+	buf, _ := dhkey.MarshalBinary()
+	lo := w.entofs[i]
+	hi := lo + len(w.entryData(e))
+	data := make([]byte, hi-lo)
+	c := e.Suite.Cipher(buf)
+	c.Message(data, hdr[lo:hi], hdr[lo:hi])
+	mac := make([]byte, maclen)
+	c.Message(mac, nil, nil)
+	return data, subtle.ConstantTimeCompare(mac, hdr[hi:hi+maclen]) == 1
+}
+
+func TestEntryMAC(t *testing.T) {
+	suiteLevel, entries, privs := testMockInputs(5, 8, 32, 16)
+	w := Writer{}
+	w.SetEntryMACLen(DefaultEntryMACLen)
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatal(err)
+	}
+	hdr, pubs, err := w.WriteWithKeys(random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range entries {
+		e := &entries[i]
+		data, ok := testOpenEntryMAC(&w, hdr, i, pubs[e.Suite], privs[i],
+			DefaultEntryMACLen)
+		if !ok || !bytes.Equal(data, e.Data) {
+			t.Fatalf("entrypoint %d failed to open", i)
+		}
+
+		// A wrong key's decryption fails the MAC check.
+		wrong, _ := test.GenKeypair(e.Suite, random.Stream)
+		if _, ok := testOpenEntryMAC(&w, hdr, i, pubs[e.Suite], wrong,
+			DefaultEntryMACLen); ok {
+			t.Fatalf("entrypoint %d opened with the wrong key", i)
+		}
+	}
+
+	// Each entrypoint's region grows by exactly the MAC length.
+	suite := test.MockSuite("Mock", 32)
+	_, pub := test.GenKeypair(suite, random.Stream)
+	one := map[abstract.Suite]int{suite: 1}
+	for _, n := range []int{0, 4, DefaultEntryMACLen} {
+		w := Writer{}
+		w.SetEntryMACLen(n)
+		hdrlen, err := w.Layout(one,
+			[]Entry{{suite, pub, make([]byte, 16)}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdrlen != 32+16+n {
+			t.Fatalf("MAC length %d: header length %d, want %d",
+				n, hdrlen, 32+16+n)
+		}
+	}
+}
+
+// Decrypt an entrypoint laid out with SetEntryVersion()
+// and SetEntryMACLen(maclen), returning its version byte, its data,
+// and whether its MAC, if any, checks out.
+func testOpenEntryVersion(w *Writer, hdr []byte, i int, pub abstract.Point,
+	pri abstract.Secret, maclen int) (byte, []byte, bool) {
+	e := &w.entries[i]
+	dhkey := e.Suite.Point().Mul(pub, pri)
+	buf, _ := dhkey.MarshalBinary()
+	lo := w.entofs[i]
+	hi := lo + 1 + len(w.entryData(e))
+	plain := make([]byte, hi-lo)
+	c := e.Suite.Cipher(buf)
+	if maclen == 0 {
+		c.XORKeyStream(plain, hdr[lo:hi])
+		return plain[0], plain[1:], true
+	}
+	c.Message(plain, hdr[lo:hi], hdr[lo:hi])
+	mac := make([]byte, maclen)
+	c.Message(mac, nil, nil)
+	ok := subtle.ConstantTimeCompare(mac, hdr[hi:hi+maclen]) == 1
+	return plain[0], plain[1:], ok
+}
+
+// Check that LayoutJSON and EachEntry report each entrypoint's region
+// as its data plus overhead bytes, as reserved in the layout.
+func testEntryRanges(t *testing.T, w *Writer, overhead int) {
+	buf, err := w.LayoutJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lj layoutJSON
+	if err := json.Unmarshal(buf, &lj); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range lj.Entries {
+		want := len(w.entryData(&w.entries[e.Entry])) + overhead
+		if e.Lo != w.entofs[e.Entry] || e.Hi-e.Lo != want {
+			t.Fatalf("JSON entry [%d-%d], want %d bytes at %d",
+				e.Lo, e.Hi, want, w.entofs[e.Entry])
+		}
+		if w.layout.reserve(e.Lo, e.Hi, true, "probe") ||
+			!w.layout.overlaps(e.Hi-1, e.Hi) {
+			t.Fatalf("JSON entry [%d-%d] not reserved", e.Lo, e.Hi)
+		}
+	}
+	n := 0
+	w.EachEntry(func(e Entry, lo, hi int) {
+		if hi-lo != len(w.entryData(&e))+overhead {
+			t.Fatalf("EachEntry range [%d-%d] for %s", lo, hi, e)
+		}
+		n++
+	})
+	if n != len(lj.Entries) {
+		t.Fatalf("EachEntry visited %d entrypoints, JSON has %d",
+			n, len(lj.Entries))
+	}
+}
+
+func TestEntryRangesMAC(t *testing.T) {
+	suiteLevel, entries, _ := testMockInputs(5, 8, 32, 16)
+	w := Writer{}
+	w.SetEntryMACLen(DefaultEntryMACLen)
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatal(err)
+	}
+	testEntryRanges(t, &w, DefaultEntryMACLen)
+}
+
+func TestEntryRangesVersion(t *testing.T) {
+	for _, maclen := range []int{0, DefaultEntryMACLen} {
+		suiteLevel, entries, _ := testMockInputs(5, 8, 32, 16)
+		w := Writer{}
+		w.SetEntryMACLen(maclen)
+		w.SetEntryVersion(1)
+		if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+			t.Fatal(err)
+		}
+		testEntryRanges(t, &w, 1+maclen)
+	}
+}
+
+func TestEntryVersion(t *testing.T) {
+	for _, maclen := range []int{0, DefaultEntryMACLen} {
+		for _, version := range []byte{0, 1, 0xff} {
+			suiteLevel, entries, privs := testMockInputs(5, 8, 32, 16)
+			w := Writer{}
+			w.SetEntryMACLen(maclen)
+			w.SetEntryVersion(version)
+			if _, err := w.Layout(suiteLevel, entries,
+				random.Stream); err != nil {
+				t.Fatal(err)
+			}
+			hdr, pubs, err := w.WriteWithKeys(random.Stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range entries {
+				e := &entries[i]
+				v, data, ok := testOpenEntryVersion(&w, hdr, i,
+					pubs[e.Suite], privs[i], maclen)
+				if !ok || v != version || !bytes.Equal(data, e.Data) {
+					t.Fatalf("MAC length %d, version %d: "+
+						"entrypoint %d opened as version %d",
+						maclen, version, i, v)
+				}
+			}
+		}
+	}
+
+	// The version byte adds one byte to each entrypoint's region.
+	suite := test.MockSuite("Mock", 32)
+	_, pub := test.GenKeypair(suite, random.Stream)
+	w := Writer{}
+	w.SetEntryVersion(1)
+	hdrlen, err := w.Layout(map[abstract.Suite]int{suite: 1},
+		[]Entry{{suite, pub, make([]byte, 16)}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdrlen != 32+1+16 {
+		t.Fatalf("header length %d, want %d", hdrlen, 32+1+16)
+	}
+}
+
+func TestEntryLenMismatch(t *testing.T) {
+	for _, delta := range []int{-1, 1} {
+		suiteLevel, entries, _ := testMockInputs(3, 8, 32, 16)
+		w := Writer{}
+		hdrlen, err := w.Layout(suiteLevel, entries, random.Stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[1].Data = make([]byte, 16+delta)
+
+		pkt := make([]byte, hdrlen)
+		err = w.WriteAt(pkt, 0, random.Stream)
+		if err == nil {
+			t.Fatalf("WriteAt accepted %d-byte data laid out for 16",
+				16+delta)
+		}
+		if !strings.Contains(err.Error(), entries[1].String()) ||
+			strings.Contains(err.Error(), entries[0].String()) {
+			t.Fatalf("error doesn't identify the entrypoint: %v", err)
+		}
+		if _, _, err := w.WriteWithKeys(random.Stream); err == nil {
+			t.Fatal("WriteWithKeys accepted mismatched data")
+		}
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("Write accepted mismatched data")
+				}
+			}()
+			w.Write(random.Stream)
+		}()
+
+		// Restoring the laid-out length makes the header writable again.
+		entries[1].Data = make([]byte, 16)
+		if err := w.WriteAt(pkt, 0, random.Stream); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Write headers with payloads from clones of one Writer concurrently,
+// checking each against the same header written sequentially.
+// Run with -race to check for data races.
+func TestWriterConcurrency(t *testing.T) {
+	suiteLevel, entries, privs := testLayoutInputs(3, 8, 16)
+	w := Writer{}
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatal(err)
+	}
+	fill := w.FillBytes()
+	real := edwards.NewAES128SHA256Ed25519(true)
+
+	type result struct {
+		hdr  []byte
+		ofs  int
+		pubs map[abstract.Suite]abstract.Point
+		w    *Writer
+	}
+	write := func(g int) result {
+		c := w.Clone()
+		key := fmt.Sprintf("TestWriterConcurrency %d", g)
+		data := []byte(fmt.Sprintf("payload %d", g))
+		ofs := c.Payload(data, real.Cipher([]byte(key)))
+		rand := real.Cipher([]byte(key + " rand"))
+		hdr, pubs, err := c.WriteWithKeys(rand)
+		if err != nil {
+			t.Error(err)
+		}
+		return result{hdr, ofs, pubs, c}
+	}
+
+	const n = 8
+	var results [n]result
+	var wg sync.WaitGroup
+	for g := 0; g < n; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			results[g] = write(g)
+		}(g)
+	}
+	wg.Wait()
+
+	for g, r := range results {
+		want := write(g)
+		if !bytes.Equal(r.hdr, want.hdr) || r.ofs != want.ofs {
+			t.Fatalf("writer %d: concurrent header differs", g)
+		}
+		for i := range entries {
+			e := &entries[i]
+			data := testOpenEntry(r.w, r.hdr, i, r.pubs[e.Suite], privs[i])
+			if !bytes.Equal(data, e.Data) {
+				t.Fatalf("writer %d: entrypoint %d corrupted", g, i)
+			}
+		}
+		key := fmt.Sprintf("TestWriterConcurrency %d", g)
+		data := []byte(fmt.Sprintf("payload %d", g))
+		got := make([]byte, len(data))
+		real.Cipher([]byte(key)).XORKeyStream(got,
+			r.hdr[r.ofs:r.ofs+len(data)])
+		if !bytes.Equal(got, data) {
+			t.Fatalf("writer %d: payload corrupted", g)
+		}
+	}
+	if w.FillBytes() != fill {
+		t.Fatal("clones' payloads changed the original's layout")
+	}
+}
+
+func TestHeaderMAC(t *testing.T) {
+	suiteLevel, entries, privs := testMockInputs(5, 8, 32, 16)
+	key := []byte("group key")
+	w := Writer{}
+	w.SetHeaderMAC(key)
+	w.SetSuffixLen(4)
+	copy(w.Suffix(), "TAIL")
+	hdrlen, err := w.Layout(suiteLevel, entries, random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr, pubs, err := w.WriteWithKeys(random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hdr) != hdrlen {
+		t.Fatalf("header is %d bytes, Layout said %d", len(hdr), hdrlen)
+	}
+	if !VerifyHeaderMAC(key, hdr) {
+		t.Fatal("header MAC didn't verify")
+	}
+	if VerifyHeaderMAC([]byte("other key"), hdr) {
+		t.Fatal("header MAC verified with the wrong key")
+	}
+
+	// The suffix precedes the MAC, and the points and entrypoints
+	// are recoverable from the header without the MAC.
+	body := hdr[:len(hdr)-HeaderMACLen]
+	if string(body[len(body)-4:]) != "TAIL" {
+		t.Fatal("suffix not placed just before the MAC")
+	}
+	for suite, nlevels := range suiteLevel {
+		if !testFindPoint(body, suite, nlevels, "").Equal(pubs[suite]) {
+			t.Fatalf("didn't find %s point", suite)
+		}
+	}
+	for i := range entries {
+		e := &entries[i]
+		data := testOpenEntry(&w, body, i, pubs[e.Suite], privs[i])
+		if !bytes.Equal(data, e.Data) {
+			t.Fatalf("entrypoint %d corrupted", i)
+		}
+	}
+
+	// Flipping any bit anywhere in the header invalidates the MAC.
+	for i := range hdr {
+		hdr[i] ^= 0x10
+		if VerifyHeaderMAC(key, hdr) {
+			t.Fatalf("header MAC verified with byte %d flipped", i)
+		}
+		hdr[i] ^= 0x10
+	}
+	if VerifyHeaderMAC(key, hdr[:HeaderMACLen-1]) {
+		t.Fatal("header MAC verified a truncated header")
+	}
+}
+
+// Check that two headers for the same entrypoints, laid out identically
+// but written with fresh ephemeral keys, are unlinkable:
+// they differ in about half their bits overall,
+// in most bytes of every point and entrypoint region,
+// and neither contains any entrypoint owner's public key.
+// Only the header length, which depends on the layout, may match.
+func testUnlinkability(t *testing.T, suiteLevel map[abstract.Suite]int,
+	entries []Entry) {
+	w := Writer{}
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatal(err)
+	}
+	hdr1 := append([]byte{}, w.Write(random.Stream)...)
+	hdr2 := w.Write(random.Stream)
+
+	if d := test.BitDiff(hdr1, hdr2); d < 0.4 {
+		t.Fatalf("headers differ in only %v of their bits", d)
+	}
+	regions := [][2]int{}
+	for _, si := range w.suites.s {
+		lo, hi := si.region(si.lev)
+		regions = append(regions, [2]int{lo, hi})
+	}
+	for i := range entries {
+		lo := w.entofs[i]
+		regions = append(regions, [2]int{lo, lo + w.entlens[i]})
+	}
+	for _, r := range regions {
+		lo, hi := r[0], r[1]
+		if d := test.ByteDiff(hdr1[lo:hi], hdr2[lo:hi]); d < 0.75 {
+			t.Fatalf("region [%d-%d] differs in only %v of its bytes",
+				lo, hi, d)
+		}
+	}
+	for i := range entries {
+		pub, _ := entries[i].PubKey.MarshalBinary()
+		if bytes.Contains(hdr1, pub) || bytes.Contains(hdr2, pub) {
+			t.Fatalf("header reveals entrypoint %d's public key", i)
+		}
+	}
+}
+
+func TestUnlinkability(t *testing.T) {
+	suiteLevel, entries, _ := testLayoutInputs(5, 8, 32)
+	testUnlinkability(t, suiteLevel, entries)
+}
+
+func TestPayloadAlign(t *testing.T) {
+	for _, align := range []int{8, 16} {
+		suiteLevel, entries, privs := testMockInputs(5, 8, 36, 13)
+		w := Writer{}
+		w.SetPayloadAlign(align)
+		hdrlen, err := w.Layout(suiteLevel, entries, random.Stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var regions [][2]int
+		for _, si := range w.suites.s {
+			lo, hi := si.region(si.lev)
+			regions = append(regions, [2]int{lo, hi})
+		}
+		for i := range entries {
+			lo := w.entofs[i]
+			hi := lo + len(entries[i].Data)
+			if lo%align != 0 {
+				t.Fatalf("align %d: entrypoint %d at offset %d",
+					align, i, lo)
+			}
+			if hi > hdrlen {
+				t.Fatalf("align %d: entrypoint %d ends at %d, "+
+					"past header length %d", align, i, hi, hdrlen)
+			}
+			for _, r := range regions {
+				if lo < r[1] && r[0] < hi {
+					t.Fatalf("align %d: entrypoint %d [%d-%d] "+
+						"overlaps [%d-%d]", align, i, lo, hi,
+						r[0], r[1])
+				}
+			}
+			regions = append(regions, [2]int{lo, hi})
+		}
+		ofs := w.Payload([]byte("payload"), random.Stream)
+		if ofs%align != 0 {
+			t.Fatalf("align %d: payload at offset %d", align, ofs)
+		}
+
+		hdr, pubs, err := w.WriteWithKeys(random.Stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range entries {
+			e := &entries[i]
+			data := testOpenEntry(&w, hdr, i, pubs[e.Suite], privs[i])
+			if !bytes.Equal(data, e.Data) {
+				t.Fatalf("align %d: entrypoint %d corrupted", align, i)
+			}
+		}
+	}
+}
+
+// Find an entrypoint's data in a header laid out with SetScatterPayloads,
+// as its owner would: derive the entrypoint's alternative positions
+// and try decrypting each, returning the offset at which want appears.
+func testFindEntry(hdr []byte, e *Entry, pub abstract.Point,
+	pri abstract.Secret, want []byte, domain string) int {
+	dhkey := e.Suite.Point().Mul(pub, pri)
+	key, _ := dhkey.MarshalBinary()
+	buf, _ := e.PubKey.MarshalBinary()
+	str := fmt.Sprintf("%sNegoEntrypoint:%s:%x", domain, e.Suite, buf)
+	rand := e.Suite.Cipher([]byte(str))
+	levofs := 0
+	for i := 0; levofs < len(hdr); i++ {
+		var tag [4]byte
+		rand.XORKeyStream(tag[:], tag[:])
+		levlen := 1 << uint(i)
+		levidx := int(binary.BigEndian.Uint32(tag[:])) & (levlen - 1)
+		lo := levofs + levidx*len(want)
+		if lo+len(want) <= len(hdr) {
+			data := make([]byte, len(want))
+			e.Suite.Cipher(key).XORKeyStream(data,
+				hdr[lo:lo+len(want)])
+			if bytes.Equal(data, want) {
+				return lo
+			}
+		}
+		levofs += levlen * len(want)
+	}
+	return -1
+}
+
+func TestScatterPayloads(t *testing.T) {
+	suiteLevel, entries, privs := testMockInputs(5, 8, 32, 16)
+	w := Writer{}
+	w.SetPositionDomain("scatter")
+	w.SetScatterPayloads(true)
+	hdrlen, err := w.Layout(suiteLevel, entries, random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Entrypoints overlap neither points nor each other.
+	var regions [][2]int
+	for _, si := range w.suites.s {
+		lo, hi := si.region(si.lev)
+		regions = append(regions, [2]int{lo, hi})
+	}
+	for i := range entries {
+		lo := w.entofs[i]
+		hi := lo + len(entries[i].Data)
+		if hi > hdrlen {
+			t.Fatalf("entrypoint %d ends at %d, past header length %d",
+				i, hi, hdrlen)
+		}
+		for _, r := range regions {
+			if lo < r[1] && r[0] < hi {
+				t.Fatalf("entrypoint %d [%d-%d] overlaps [%d-%d]",
+					i, lo, hi, r[0], r[1])
+			}
+		}
+		regions = append(regions, [2]int{lo, hi})
+	}
+
+	// Each owner finds its entrypoint by deriving the same positions.
+	hdr, pubs, err := w.WriteWithKeys(random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range entries {
+		e := &entries[i]
+		ofs := testFindEntry(hdr, e, pubs[e.Suite], privs[i], e.Data,
+			"scatter")
+		if ofs != w.entofs[i] {
+			t.Fatalf("entrypoint %d found at %d, laid out at %d",
+				i, ofs, w.entofs[i])
+		}
+	}
+
+	// Positions are bounded by the maximum header length.
+	w = Writer{}
+	w.SetScatterPayloads(true)
+	w.SetMaxLen(5*32 + 5*16)
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err == nil &&
+		w.hdrlen > 5*32+5*16 {
+		t.Fatalf("header length %d exceeds maximum", w.hdrlen)
+	}
+}
+
+type testFailWriter struct{}
+
+func (testFailWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestWriteStream(t *testing.T) {
+	suiteLevel, entries, _ := testMockInputs(5, 8, 32, 16)
+	w := Writer{}
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatal(err)
+	}
+	real := edwards.NewAES128SHA256Ed25519(true)
+	want := append([]byte{}, w.Write(real.Cipher([]byte("stream")))...)
+
+	w.buf = nil
+	var out bytes.Buffer
+	n, err := w.WriteStream(&out, real.Cipher([]byte("stream")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(want) || !bytes.Equal(out.Bytes(), want) {
+		t.Fatal("WriteStream produced a different header than Write")
+	}
+	if _, err := w.WriteStream(testFailWriter{}, random.Stream); err == nil {
+		t.Fatal("WriteStream ignored a write error")
+	}
+}
+
+func TestDecoys(t *testing.T) {
+	suiteLevel, entries, privs := testMockInputs(5, 8, 32, 16)
+	var hdrlen0, reserved0 int
+	for _, n := range []int{0, 1, 3, 10} {
+		w := Writer{}
+		w.SetDecoys(n)
+		hdrlen, err := w.Layout(suiteLevel, entries, random.Stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reserved := hdrlen - w.FillBytes()
+		if n == 0 {
+			hdrlen0, reserved0 = hdrlen, reserved
+		}
+		if len(w.decoys) != n || reserved != reserved0+n*16 {
+			t.Fatalf("%d decoys: %d decoys reserving %d bytes, want %d",
+				n, len(w.decoys), reserved-reserved0, n*16)
+		}
+		if hdrlen < hdrlen0 || hdrlen > hdrlen0+n*16 {
+			t.Fatalf("%d decoys: header length %d, without %d",
+				n, hdrlen, hdrlen0)
+		}
+
+		var regions [][2]int
+		for _, si := range w.suites.s {
+			lo, hi := si.region(si.lev)
+			regions = append(regions, [2]int{lo, hi})
+		}
+		for i := range entries {
+			lo := w.entofs[i]
+			regions = append(regions, [2]int{lo, lo + 16})
+		}
+		for _, lo := range w.decoys {
+			hi := lo + 16
+			if hi > hdrlen {
+				t.Fatalf("decoy [%d-%d] past header end", lo, hi)
+			}
+			for _, r := range regions {
+				if lo < r[1] && r[0] < hi {
+					t.Fatalf("decoy [%d-%d] overlaps [%d-%d]",
+						lo, hi, r[0], r[1])
+				}
+			}
+			regions = append(regions, [2]int{lo, hi})
+		}
+
+		hdr, pubs, err := w.WriteWithKeys(random.Stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range entries {
+			e := &entries[i]
+			data := testOpenEntry(&w, hdr, i, pubs[e.Suite], privs[i])
+			if !bytes.Equal(data, e.Data) {
+				t.Fatalf("%d decoys: entrypoint %d corrupted", n, i)
+			}
+		}
+		for _, lo := range w.decoys {
+			if testOnesFraction(hdr[lo:lo+16]) == 0 {
+				t.Fatalf("decoy at %d not filled", lo)
+			}
+		}
+	}
+}
+
+func TestCanFit(t *testing.T) {
+	suiteLevel, entries, _ := testMockInputs(5, 8, 32, 16)
+	w := Writer{}
+	if !w.CanFit(suiteLevel, 16, len(entries)) {
+		t.Fatal("CanFit rejected an unlimited header")
+	}
+	w.SetMaxLen(5*32 + 5*16 - 1)
+	if w.CanFit(suiteLevel, 16, len(entries)) {
+		t.Fatal("CanFit accepted a header too short for its contents")
+	}
+	w.SetMaxLen(5*32 + 5*16)
+	if !w.CanFit(suiteLevel, 16, len(entries)) {
+		t.Fatal("CanFit rejected a header just long enough")
+	}
+	w.SetMaxEntries(4)
+	if w.CanFit(suiteLevel, 16, len(entries)) {
+		t.Fatal("CanFit accepted too many entrypoints")
+	}
+
+	// CanFit never rejects a layout that Layout accepts.
+	for max := 200; max <= 2000; max += 40 {
+		w := Writer{}
+		w.SetMaxLen(max)
+		w.SetDecoys(2)
+		fit := w.CanFit(suiteLevel, 16, len(entries))
+		_, err := w.Layout(suiteLevel, entries, random.Stream)
+		if err == nil && !fit {
+			t.Fatalf("CanFit rejected max %d, but Layout fit it", max)
+		}
+	}
+}
+
+func TestMinHeaderSize(t *testing.T) {
+	suiteLevel, entries, _ := testMockInputs(5, 8, 32, 16)
+	min := MinHeaderSize(suiteLevel, 16, len(entries))
+	if min != 5*32+5*16 {
+		t.Fatalf("MinHeaderSize = %d, want %d", min, 5*32+5*16)
+	}
+	if MinHeaderSize(suiteLevel, 16, 0) != 5*32 {
+		t.Fatal("MinHeaderSize counted entrypoints that don't exist")
+	}
+
+	// Layout never produces a header smaller than the floor.
+	for i := 0; i < 20; i++ {
+		w := Writer{}
+		w.SetPositionDomain(fmt.Sprintf("domain %d", i))
+		hdrlen, err := w.Layout(suiteLevel, entries, random.Stream)
+		if err != nil {
+			continue
+		}
+		if hdrlen < min {
+			t.Fatalf("header length %d below minimum %d", hdrlen, min)
+		}
+	}
+}
+
+// Suite that records every Secret it creates, to check for wiping.
+type testRecordSuite struct {
+	abstract.Suite
+	secrets []abstract.Secret
+}
+
+func (s *testRecordSuite) Secret() abstract.Secret {
+	sec := s.Suite.Secret()
+	s.secrets = append(s.secrets, sec)
+	return sec
+}
+
+func testWipe(t *testing.T, wipe bool) {
+	suite := &testRecordSuite{Suite: test.MockSuite("MockSuite", 32)}
+	_, pub := test.GenKeypair(suite.Suite, random.Stream)
+	suiteLevel := map[abstract.Suite]int{suite: 1}
+	entries := []Entry{{suite, pub, []byte("entrypoint data")}}
+	w := Writer{}
+	w.SetWipe(wipe)
+	if _, err := w.Layout(suiteLevel, entries, nil); err != nil {
+		t.Fatal(err)
+	}
+	suite.secrets = nil
+	w.Write(random.Stream)
+	if len(suite.secrets) != 1 {
+		t.Fatalf("Write created %d secrets, want 1", len(suite.secrets))
+	}
+	zero := suite.Suite.Secret().Zero()
+	if suite.secrets[0].Equal(zero) != wipe {
+		t.Fatalf("ephemeral secret wiped: %v, want %v", !wipe, wipe)
+	}
+}
+
+func TestWipe(t *testing.T) {
+	testWipe(t, true)
+	testWipe(t, false)
+}
+
+func TestEntryString(t *testing.T) {
+	suite := test.MockSuite("MockSuite", 32)
+	_, pub := test.GenKeypair(suite, random.Stream)
+	data := []byte("secret entrypoint data")
+	e := Entry{suite, pub, data}
+	buf, _ := pub.MarshalBinary()
+	want := fmt.Sprintf("(MockSuite)%x[%d bytes]", buf[:4], len(data))
+	if e.String() != want {
+		t.Fatalf("String() = %q, want %q", e.String(), want)
+	}
+	if s := fmt.Sprintf("%v", &e); s != want {
+		t.Fatalf("%%v of *Entry = %q, want %q", s, want)
+	}
+	text, err := e.MarshalText()
+	if err != nil || string(text) != want {
+		t.Fatalf("MarshalText() = %q, %v", text, err)
+	}
+	if strings.Contains(e.String(), string(data)) ||
+		strings.Contains(e.String(), fmt.Sprintf("%x", data[:4])) {
+		t.Fatal("String() reveals entrypoint data")
+	}
+	if s := (Entry{Suite: suite}).String(); s != "(MockSuite)nil[0 bytes]" {
+		t.Fatalf("String() of empty entry = %q", s)
+	}
+}
+
+func TestEachEntry(t *testing.T) {
+	suiteLevel, entries, _ := testMockInputs(5, 8, 32, 16)
+	entries[2].Data = make([]byte, 40)
+	w := Writer{}
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatal(err)
+	}
+	seen := 0
+	last := -1
+	w.EachEntry(func(e Entry, lo, hi int) {
+		if lo <= last {
+			t.Fatalf("entrypoint at %d not after previous at %d",
+				lo, last)
+		}
+		if hi-lo != len(e.Data) {
+			t.Fatalf("entrypoint %s range [%d-%d]", e, lo, hi)
+		}
+		last = lo
+		seen++
+	})
+	if seen != len(entries) {
+		t.Fatalf("visited %d of %d entrypoints", seen, len(entries))
+	}
+}
+
+// Stream that produces n random bytes and then runs dry,
+// passing its input through unchanged.
+type testShortStream struct {
+	n int
+}
+
+func (s *testShortStream) XORKeyStream(dst, src []byte) {
+	copy(dst, src)
+	n := len(src)
+	if n > s.n {
+		n = s.n
+	}
+	random.Stream.XORKeyStream(dst[:n], src[:n])
+	s.n -= n
+}
+
+func TestExhaustedStream(t *testing.T) {
+	suiteLevel, entries, _ := testMockInputs(3, 8, 32, 16)
+	w := Writer{}
+	hdrlen, err := w.Layout(suiteLevel, entries, random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteAt(make([]byte, hdrlen), 0, &testShortStream{})
+	if err == nil || !strings.Contains(err.Error(), "random stream") {
+		t.Fatalf("WriteAt with exhausted stream: %v", err)
+	}
+	if _, _, err := w.WriteWithKeys(&testShortStream{}); err == nil {
+		t.Fatal("WriteWithKeys accepted an exhausted stream")
+	}
+	var out bytes.Buffer
+	if _, err := w.WriteStream(&out, &testShortStream{}); err == nil {
+		t.Fatal("WriteStream accepted an exhausted stream")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("Write accepted an exhausted stream")
+			}
+		}()
+		w.Write(&testShortStream{})
+	}()
+
+	// A stream that still has output passes the check.
+	err = w.WriteAt(make([]byte, hdrlen), 0, &testShortStream{1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEqualMaxDifferentPlen(t *testing.T) {
+	// With 3 levels, MockA1's 32-byte positions and MockB3's 48-byte
+	// positions both end at 192, so the suites tie in the sort by max,
+	// but their top positions [160-192] and [144-192] overlap.
+	// Limiting the header to 144 bytes leaves MockA1 its lower levels
+	// and MockB3 its middle level, the first free one below its top.
+	a := test.MockSuite("MockA1", 32)
+	b := test.MockSuite("MockB3", 48)
+	suiteLevel := map[abstract.Suite]int{a: 3, b: 3}
+	var entries []Entry
+	var privs []abstract.Secret
+	for _, suite := range []abstract.Suite{a, b} {
+		pri, pub := test.GenKeypair(suite, random.Stream)
+		data := random.Bytes(16, random.Stream)
+		entries = append(entries, Entry{suite, pub, data})
+		privs = append(privs, pri)
+	}
+	w := Writer{}
+	w.SetMaxLen(144)
+	hdrlen, err := w.Layout(suiteLevel, entries, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sa, sb := w.simap[a], w.simap[b]
+	if fmt.Sprint(sa.pos) != "[0 32 160]" ||
+		fmt.Sprint(sb.pos) != "[0 96 144]" || sa.max != sb.max {
+		t.Fatalf("unexpected positions %v and %v", sa.pos, sb.pos)
+	}
+	alo, ahi := sa.region(sa.lev)
+	blo, bhi := sb.region(sb.lev)
+	if alo != 0 || ahi != 32 || blo != 96 || bhi != 144 {
+		t.Fatalf("primary positions [%d-%d] and [%d-%d], "+
+			"want [0-32] and [96-144]", alo, ahi, blo, bhi)
+	}
+	end := bhi
+	for i := range entries {
+		if hi := w.entofs[i] + 16; hi > end {
+			end = hi
+		}
+	}
+	if hdrlen != end {
+		t.Fatalf("header length %d, but layout ends at %d", hdrlen, end)
+	}
+
+	hdr, pubs, err := w.WriteWithKeys(random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range entries {
+		e := &entries[i]
+		if !testFindPoint(hdr, e.Suite, 3, "").Equal(pubs[e.Suite]) {
+			t.Fatalf("didn't find %s point", e.Suite)
+		}
+		data := testOpenEntry(&w, hdr, i, pubs[e.Suite], privs[i])
+		if !bytes.Equal(data, e.Data) {
+			t.Fatalf("entrypoint %d corrupted", i)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	suiteLevel, entries, privs := testMockInputs(10, 8, 32, 16)
+	w := Writer{}
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := w.MarshalBinary()
+
+	// A dry run matches a real layout of the same suites.
+	other, _, _ := testMockInputs(6, 8, 48, 16)
+	levels, hdrlen, err := w.DryRun(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var real Writer
+	reallen, err := real.Layout(other, nil, random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdrlen != reallen || len(levels) != len(other) {
+		t.Fatalf("dry run: %d suites, hdrlen %d; real: %d suites, %d",
+			len(levels), hdrlen, len(other), reallen)
+	}
+	for suite, lev := range levels {
+		if real.simap[suite].lev != lev {
+			t.Fatalf("%s: dry run level %d, real level %d",
+				suite, lev, real.simap[suite].lev)
+		}
+	}
+
+	// The Writer's own layout is untouched and still works.
+	after, _ := w.MarshalBinary()
+	if !bytes.Equal(before, after) {
+		t.Fatal("DryRun changed the Writer's layout")
+	}
+	hdr, pubs, err := w.WriteWithKeys(random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range entries {
+		e := &entries[i]
+		data := testOpenEntry(&w, hdr, i, pubs[e.Suite], privs[i])
+		if !bytes.Equal(data, e.Data) {
+			t.Fatalf("entrypoint %d corrupted after DryRun", i)
+		}
+	}
+
+	if _, _, err := w.DryRun(map[abstract.Suite]int{
+		test.MockSuite("Mock", 32): 0}); err == nil {
+		t.Fatal("DryRun accepted a level less than 1")
+	}
+}
+
+func TestEmptySuiteLevel(t *testing.T) {
+	w := Writer{}
+	hdrlen, err := w.Layout(map[abstract.Suite]int{}, nil, random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdrlen != 0 {
+		t.Fatalf("empty layout has header length %d", hdrlen)
+	}
+	if hdr := w.Write(random.Stream); len(hdr) != 0 {
+		t.Fatalf("empty layout wrote %d bytes", len(hdr))
+	}
+
+	// A suffix alone makes up the whole header.
+	suffix := []byte("trailer")
+	w = Writer{}
+	w.SetSuffixLen(len(suffix))
+	hdrlen, err = w.Layout(nil, nil, random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdrlen != len(suffix) {
+		t.Fatalf("suffix-only layout has header length %d, want %d",
+			hdrlen, len(suffix))
+	}
+	copy(w.Suffix(), suffix)
+	if hdr := w.Write(random.Stream); !bytes.Equal(hdr, suffix) {
+		t.Fatalf("suffix-only layout wrote %x", hdr)
+	}
+}
+
+func TestLayoutTwice(t *testing.T) {
+	suiteLevel, entries, privs := testLayoutInputs(5, 8, 16)
+	w := Writer{}
+	hdrlen1, err := w.Layout(suiteLevel, entries, random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(random.Stream)
+	ofs1 := w.entofs
+
+	hdrlen2, err := w.Layout(suiteLevel, entries, random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdrlen1 != hdrlen2 {
+		t.Fatalf("second Layout gave hdrlen %d, first %d",
+			hdrlen2, hdrlen1)
+	}
+	for i := range entries {
+		if w.entofs[i] != ofs1[i] {
+			t.Fatalf("entrypoint %d moved from %d to %d",
+				i, ofs1[i], w.entofs[i])
+		}
+	}
+
+	hdr, pubs, err := w.WriteWithKeys(random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hdr) != hdrlen2 {
+		t.Fatalf("header is %d bytes, Layout said %d", len(hdr), hdrlen2)
+	}
+	for i := range entries {
+		e := &entries[i]
+		data := testOpenEntry(&w, hdr, i, pubs[e.Suite], privs[i])
+		if !bytes.Equal(data, e.Data) {
+			t.Fatalf("entrypoint %d didn't decrypt", i)
+		}
+	}
+}
+
+func TestSetMaxEntries(t *testing.T) {
+	suiteLevel, entries, _ := testMockInputs(5, 8, 32, 16)
+	w := Writer{}
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatalf("unlimited by default: %v", err)
+	}
+	w.SetMaxEntries(len(entries))
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatalf("at the limit: %v", err)
+	}
+	w.SetMaxEntries(len(entries) - 1)
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err == nil {
+		t.Fatal("Layout accepted too many entrypoints")
+	}
+	w.SetMaxEntries(0)
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatalf("limit removed: %v", err)
+	}
+}
+
+func TestSuiteNameClash(t *testing.T) {
+	suiteLevel, entries, _ := testMockInputs(3, 8, 32, 16)
+	alias := test.MockSuite("Mock1", 32) // distinct object, same name
+	w := Writer{}
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddSuite(alias, 8); err == nil {
+		t.Fatal("AddSuite accepted a suite sharing another's name")
+	}
+
+	suiteLevel[alias] = 8
+	_, err := w.Layout(suiteLevel, entries, random.Stream)
+	if err == nil || !strings.Contains(err.Error(), "Mock1") {
+		t.Fatalf("Layout with aliased suite: %v", err)
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	w := Writer{}
+	suiteLevel, entries, _ := testMockInputs(1, 8, 32, 16)
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.Conflicts()) != 0 {
+		t.Fatalf("conflicts with a single suite: %v", w.Conflicts())
+	}
+
+	suiteLevel, entries, _ = testMockInputs(10, 8, 32, 16)
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.Conflicts()) == 0 {
+		t.Fatal("no conflicts among 10 congested suites")
+	}
+	for _, c := range w.Conflicts() {
+		si, sj := w.simap[c.Suite], w.simap[c.ConflictingSuite]
+		if si == nil || sj == nil || si == sj {
+			t.Fatalf("bad conflict %v", c)
+		}
+		if c.TriedLevel == si.lev {
+			t.Fatalf("%s picked conflicting level %d",
+				c.Suite, c.TriedLevel)
+		}
+		lo, hi := si.region(c.TriedLevel)
+		overlap := false
+		for j := range sj.pos {
+			olo, ohi := sj.region(j)
+			overlap = overlap || (lo < ohi && olo < hi)
+		}
+		if !overlap {
+			t.Fatalf("%s level %d doesn't overlap %s", c.Suite,
+				c.TriedLevel, c.ConflictingSuite)
+		}
+	}
+}
+
+func TestExcludedRanges(t *testing.T) {
+	w := Writer{}
+	if len(w.ExcludedRanges()) != 0 {
+		t.Fatal("excluded ranges before Layout")
+	}
+	suiteLevel, entries, _ := testMockInputs(10, 8, 32, 16)
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatal(err)
+	}
+	ranges := w.ExcludedRanges()
+
+	// The ranges are sorted, disjoint and cover exactly the positions.
+	covered := func(lo, hi int) bool {
+		for _, r := range ranges {
+			if r.Lo <= lo && lo < r.Hi {
+				lo = r.Hi
+			}
+		}
+		return lo >= hi
+	}
+	for i, r := range ranges {
+		if r.Lo >= r.Hi || (i > 0 && ranges[i-1].Hi > r.Lo) {
+			t.Fatalf("bad range %d: %v", i, ranges)
+		}
+		inside := false
+		for _, si := range w.suites.s {
+			for j := range si.pos {
+				lo, hi := si.region(j)
+				inside = inside || (lo <= r.Lo && r.Hi <= hi)
+			}
+		}
+		if !inside {
+			t.Fatalf("range [%d-%d] isn't a point position", r.Lo, r.Hi)
+		}
+	}
+	for _, si := range w.suites.s {
+		for j := range si.pos {
+			if lo, hi := si.region(j); !covered(lo, hi) {
+				t.Fatalf("%s level %d [%d-%d] not excluded",
+					si, j, lo, hi)
+			}
+		}
+
+		// Each primary position was claimed first by its own suite.
+		lo, hi := si.region(si.lev)
+		for _, r := range ranges {
+			if r.Lo < hi && lo < r.Hi && r.Name != si.String() {
+				t.Fatalf("%s primary [%d-%d] claimed by %s",
+					si, lo, hi, r.Name)
+			}
+		}
+	}
+}
+
+// Create a congested set of mock suites with a mix of point lengths.
+func testCongestedLevels() map[abstract.Suite]int {
+	suiteLevel := make(map[abstract.Suite]int)
+	for i := 0; i < 12; i++ {
+		plen := []int{16, 32, 48}[i%3]
+		suiteLevel[test.MockSuite(fmt.Sprintf("Mock%d", i), plen)] = 6
+	}
+	return suiteLevel
+}
+
+func TestOptimize(t *testing.T) {
+	suiteLevel := testCongestedLevels()
+	w := Writer{}
+	greedy, err := w.Layout(suiteLevel, nil, random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	real := edwards.NewAES128SHA256Ed25519(true)
+	var order string
+	for run := 0; run < 2; run++ {
+		w := Writer{}
+		w.SetOptimize(true)
+		rand := real.Cipher([]byte("TestOptimize"))
+		hdrlen, err := w.Layout(suiteLevel, nil, rand)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdrlen > greedy {
+			t.Fatalf("optimized hdrlen %d exceeds greedy %d",
+				hdrlen, greedy)
+		}
+		if run == 1 && fmt.Sprint(w.suites.s) != order {
+			t.Fatal("optimized layout not deterministic given seed")
+		}
+		order = fmt.Sprint(w.suites.s)
+
+		// The layout must remain valid: every point must be findable.
+		hdr, pubs, err := w.WriteWithKeys(random.Stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for suite, nlevels := range suiteLevel {
+			pnt := testFindPoint(hdr, suite, nlevels, "")
+			if !pnt.Equal(pubs[suite]) {
+				t.Fatalf("didn't find %s point", suite)
+			}
+		}
+		t.Logf("greedy hdrlen %d, optimized %d", greedy, hdrlen)
+	}
+}
+
+func benchmarkLayout(b *testing.B, optimize bool) {
+	suiteLevel := testCongestedLevels()
+	real := edwards.NewAES128SHA256Ed25519(true)
+	hdrlen := 0
+	for i := 0; i < b.N; i++ {
+		w := Writer{}
+		w.SetOptimize(optimize)
+		rand := real.Cipher([]byte("BenchmarkLayout"))
+		l, err := w.Layout(suiteLevel, nil, rand)
+		if err != nil {
+			b.Fatal(err)
+		}
+		hdrlen = l
+	}
+	b.ReportMetric(float64(hdrlen), "hdrlen")
+}
+
+func BenchmarkLayoutGreedy(b *testing.B)   { benchmarkLayout(b, false) }
+func BenchmarkLayoutOptimize(b *testing.B) { benchmarkLayout(b, true) }
+
+func benchmarkLayoutGrow(b *testing.B, grow bool) {
+	suiteLevel, entries, _ := testMockInputs(200, 16, 32, 16)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := Writer{}
+		if grow {
+			w.Grow(len(suiteLevel))
+		}
+		if _, err := w.Layout(suiteLevel, entries, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLayout200(b *testing.B)     { benchmarkLayoutGrow(b, false) }
+func BenchmarkLayout200Grow(b *testing.B) { benchmarkLayoutGrow(b, true) }
+
+// Check that preallocating with Grow doesn't affect the resulting layout,
+// whether the hint is too small, exact, or generous.
+func TestGrow(t *testing.T) {
+	suiteLevel, entries, _ := testMockInputs(20, 16, 32, 16)
+	w := Writer{}
+	if _, err := w.Layout(suiteLevel, entries, nil); err != nil {
+		t.Fatal(err)
+	}
+	want, err := w.LayoutJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{0, 5, 20, 100} {
+		w := Writer{}
+		w.Grow(n)
+		for i := 0; i < 2; i++ { // also reuse the pools
+			if _, err := w.Layout(suiteLevel, entries, nil); err != nil {
+				t.Fatal(err)
+			}
+			got, err := w.LayoutJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("Grow(%d) changed layout:\n%s\nwant:\n%s",
+					n, got, want)
+			}
+		}
+	}
+}
+
+func TestConflictProbability(t *testing.T) {
+	real := edwards.NewAES128SHA256Ed25519(true)
+	rand := real.Cipher([]byte("TestConflictProbability"))
+
+	// A lone suite never conflicts with anything.
+	lone := map[abstract.Suite]int{test.MockSuite("Mock", 32): 6}
+	if p := ConflictProbability(lone, 20, rand); p != 0 {
+		t.Fatalf("lone suite conflict probability %v, want 0", p)
+	}
+
+	// Many suites crowded into few levels nearly always conflict.
+	p := ConflictProbability(testCongestedLevels(), 20, rand)
+	if p < 0.5 || p > 1 {
+		t.Fatalf("congested conflict probability %v", p)
+	}
+
+	// No trials means no conflicts, rather than NaN.
+	if p := ConflictProbability(lone, 0, rand); p != 0 {
+		t.Fatalf("conflict probability %v over no trials, want 0", p)
+	}
+
+	// Trial domains stay out of the position cache.
+	SetSuiteCacheSize(100)
+	defer SetSuiteCacheSize(0)
+	ConflictProbability(testCongestedLevels(), 5, rand)
+	if n := positions.len(); n != 0 {
+		t.Fatalf("trials cached positions of %d suites", n)
+	}
+}
+
+func TestWriteAt(t *testing.T) {
+	suiteLevel, entries, _ := testMockInputs(5, 8, 32, 16)
+	w := Writer{}
+	hdrlen, err := w.Layout(suiteLevel, entries, random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	real := edwards.NewAES128SHA256Ed25519(true)
+	hdr := w.Write(real.Cipher([]byte("TestWriteAt")))
+	hdr = append([]byte{}, hdr...)
+
+	w.buf = nil
+	pkt := random.Bytes(100+hdrlen+50, random.Stream)
+	tail := append([]byte{}, pkt[100+hdrlen:]...)
+	err = w.WriteAt(pkt, 100, real.Cipher([]byte("TestWriteAt")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pkt[100:100+hdrlen], hdr) {
+		t.Fatal("WriteAt produced a different header than Write")
+	}
+	if !bytes.Equal(pkt[100+hdrlen:], tail) {
+		t.Fatal("WriteAt wrote past the end of the header")
+	}
+
+	if err := w.WriteAt(pkt, 101+50, random.Stream); err == nil {
+		t.Fatal("WriteAt accepted too small a destination")
+	}
+}
+
+func TestPayloadAvoidsPoints(t *testing.T) {
+	// Many small suites at few levels pack points densely near the start,
+	// where payloads of assorted sizes would naturally land.
+	suiteLevel := make(map[abstract.Suite]int)
+	var entries []Entry
+	var privs []abstract.Secret
+	for i := 0; i < 8; i++ {
+		s := test.MockSuite(fmt.Sprintf("Mock%d", i), 8+8*(i%3))
+		suiteLevel[s] = 6
+		for j := 0; j < 3; j++ {
+			pri := s.Secret().Pick(random.Stream)
+			pub := s.Point().Mul(nil, pri)
+			data := random.Bytes(1+5*j+i, random.Stream)
+			entries = append(entries, Entry{s, pub, data})
+			privs = append(privs, pri)
+		}
+	}
+	w := Writer{}
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatal(err)
+	}
+
+	type extent struct {
+		lo, hi int
+		what   string
+	}
+	var used []extent
+	for _, si := range w.suites.s {
+		lo, hi := si.region(si.lev)
+		used = append(used, extent{lo, hi, si.String()})
+	}
+	for i := range entries {
+		lo := w.entofs[i]
+		used = append(used, extent{lo, lo + len(entries[i].Data),
+			entries[i].String()})
+	}
+	for i := range used {
+		for j := i + 1; j < len(used); j++ {
+			a, b := used[i], used[j]
+			if a.lo < b.hi && b.lo < a.hi {
+				t.Fatalf("%s [%d-%d] overlaps %s [%d-%d]",
+					a.what, a.lo, a.hi, b.what, b.lo, b.hi)
+			}
+		}
+	}
+
+	hdr, pubs, err := w.WriteWithKeys(random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for suite, nlevels := range suiteLevel {
+		if !testFindPoint(hdr, suite, nlevels, "").Equal(pubs[suite]) {
+			t.Fatalf("didn't find %s point", suite)
+		}
+	}
+	for i := range entries {
+		e := &entries[i]
+		data := testOpenEntry(&w, hdr, i, pubs[e.Suite], privs[i])
+		if !bytes.Equal(data, e.Data) {
+			t.Fatalf("entrypoint %d didn't decrypt", i)
+		}
+	}
+}
+
+func TestEntryLenLimit(t *testing.T) {
+	suiteLevel, entries, _ := testMockInputs(2, 8, 32, 16)
+	w := Writer{}
+	entries[1].Data = make([]byte, maxEntryLen)
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatalf("maximum entry length: %v", err)
+	}
+	entries[1].Data = make([]byte, maxEntryLen+1)
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err == nil {
+		t.Fatal("Layout accepted an oversized entrypoint")
+	}
+	entries[1].Data = nil
+	w.SetSharedKey(make([]byte, maxEntryLen+1))
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err == nil {
+		t.Fatal("Layout accepted an oversized shared key")
+	}
+}
+
+func TestUnknownSuites(t *testing.T) {
+	suiteLevel, entries, privs := testMockInputs(3, 8, 32, 16)
+	w := Writer{}
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatal(err)
+	}
+	hdr := w.Write(random.Stream)
+
+	// A reader knowing only one suite and its level bound,
+	// and nothing about the other suites in the header,
+	// must still recover that suite's point and open its entrypoint.
+	for i := range entries {
+		e := &entries[i]
+		pnt := testFindPoint(hdr, e.Suite, suiteLevel[e.Suite], "")
+		data := testOpenEntry(&w, hdr, i, pnt, privs[i])
+		if !bytes.Equal(data, e.Data) {
+			t.Fatalf("entrypoint %d didn't open knowing only %s",
+				i, e.Suite)
+		}
+	}
+}
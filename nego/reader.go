@@ -0,0 +1,361 @@
+package nego
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"github.com/dedis/crypto/abstract"
+	dcipher "github.com/dedis/crypto/cipher"
+	"io"
+)
+
+// Number of entrypoint offsets ReadAt() probes per read from its source.
+const readAtWindow = 4096
+
+// Reader finds and decrypts the entrypoint a Writer laid out
+// for the holder of a private key.
+// A Reader needs only its own suite's level bound
+// and the configuration the Writer used,
+// treating the rest of the header as opaque.
+// Since entrypoints carry no marker, the Reader recognizes its own
+// by its MAC (see Writer.SetEntryMACLen()), trying every offset
+// at which it might start, in time independent of where it is found.
+// Readers strip any header MAC (see Writer.SetHeaderMAC()) before reading.
+type Reader struct {
+	levels  map[abstract.Suite]int     // Level bound of each suite
+	datlen  int                        // Length of entrypoint data
+	entmac  int                        // Length of each entrypoint MAC
+	hasver  bool                       // Entrypoints carry a version
+	domain  string                     // Position domain
+	order   binary.ByteOrder           // Byte order of position tags
+	poshash func([]byte) cipher.Stream // Position stream, if not suite's
+}
+
+// Set the maximum level at which a ciphersuite's point may be encoded,
+// as in the suiteLevel map the Writer was given.
+// The Reader reads only headers for suites whose level it knows.
+func (r *Reader) SetSuiteLevel(suite abstract.Suite, nlevels int) {
+	if r.levels == nil {
+		r.levels = make(map[abstract.Suite]int)
+	}
+	r.levels[suite] = nlevels
+}
+
+// Set the length of the entrypoint data to read,
+// that of the Data slice in the Writer's entrypoint.
+func (r *Reader) SetEntryLen(n int) {
+	r.datlen = n
+}
+
+// Set the length of the MAC following each entrypoint's data,
+// which must match the Writer's SetEntryMACLen().
+// The Reader relies on the MAC to recognize its entrypoint,
+// so it reads nothing while the length is 0, the default.
+func (r *Reader) SetEntryMACLen(n int) {
+	r.entmac = n
+}
+
+// Set whether entrypoints carry a format version byte before their data,
+// as written by a Writer given SetEntryVersion().
+// The Reader then returns each entrypoint's version along with its data,
+// leaving it to the caller to handle versions it doesn't know.
+func (r *Reader) SetEntryVersioned(versioned bool) {
+	r.hasver = versioned
+}
+
+// Set the domain string from which point positions derive,
+// which must match the Writer's SetPositionDomain().
+func (r *Reader) SetPositionDomain(domain string) {
+	r.domain = domain
+}
+
+// Set the byte order of position tags,
+// which must match the Writer's SetTagEndianness().
+func (r *Reader) SetTagEndianness(order binary.ByteOrder) {
+	r.order = order
+}
+
+// Set the hash from which point positions derive,
+// which must match the Writer's SetPositionHash().
+// Passing nil restores the default of each suite's own Cipher.
+func (r *Reader) SetPositionHash(hash func([]byte) cipher.Stream) {
+	r.poshash = hash
+}
+
+// Return the number of encrypted bytes in an entrypoint:
+// its data and version byte, if any.
+func (r *Reader) msgLen() int {
+	if r.hasver {
+		return r.datlen + 1
+	}
+	return r.datlen
+}
+
+// Return the number of bytes an entrypoint occupies, MAC included.
+func (r *Reader) entryLen() int {
+	return r.msgLen() + r.entmac
+}
+
+// Split a decrypted entrypoint into its data and version byte,
+// which is 0 if entrypoints carry no version.
+func (r *Reader) split(plain []byte) ([]byte, byte) {
+	if r.hasver {
+		return plain[1:], plain[0]
+	}
+	return plain, 0
+}
+
+// Derive a ciphersuite's point positions under the Reader's configuration.
+func (r *Reader) suiteInfo(suite abstract.Suite) (*suiteInfo, error) {
+	nlevels, ok := r.levels[suite]
+	if !ok {
+		return nil, errors.New("no level known for suite " +
+			suite.String())
+	}
+	if r.datlen < 1 {
+		return nil, errors.New("entrypoint length not set")
+	}
+	if r.entmac < 1 {
+		return nil, errors.New("Reader requires entrypoint MACs")
+	}
+	si := &suiteInfo{}
+	err := si.init(suite, nlevels, r.domain, r.order, r.poshash)
+	if err != nil {
+		return nil, err
+	}
+	return si, nil
+}
+
+// Recover a ciphersuite's point from a header
+// by XORing together all its positions that lie within the header.
+func (si *suiteInfo) findPoint(header []byte) abstract.Point {
+	pnt, _ := si.findPointAt(bytes.NewReader(header), len(header))
+	return pnt
+}
+
+// Recover a ciphersuite's point from a header of length hdrlen in src,
+// reading only the positions that lie within the header.
+func (si *suiteInfo) findPointAt(src io.ReaderAt, hdrlen int) (
+	abstract.Point, error) {
+	buf := make([]byte, si.plen)
+	pos := make([]byte, si.plen)
+	for j := range si.pos {
+		lo, hi := si.region(j)
+		if hi <= hdrlen {
+			if err := readAt(src, pos, lo); err != nil {
+				return nil, err
+			}
+			for k := range buf {
+				buf[k] ^= pos[k]
+			}
+		}
+	}
+	pnt := si.ste.Point()
+	pnt.(abstract.Hiding).HideDecode(buf)
+	return pnt, nil
+}
+
+// Fill buf from src at offset ofs, failing only if buf couldn't be filled,
+// since a ReaderAt may report io.EOF along with the header's last bytes.
+func readAt(src io.ReaderAt, buf []byte, ofs int) error {
+	n, err := src.ReadAt(buf, int64(ofs))
+	if n < len(buf) {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+// Derive the keys under which the holders of privs
+// would find their entrypoints, given the suite's point in a header.
+func entryKeys(si *suiteInfo, pnt abstract.Point,
+	privs []abstract.Secret) [][]byte {
+	keys := make([][]byte, len(privs))
+	for i, priv := range privs {
+		dhkey := si.ste.Point().Mul(pnt, priv)
+		keys[i], _ = dhkey.MarshalBinary()
+		dhkey.Null()
+	}
+	return keys
+}
+
+// Try to open the entrypoint that would occupy ent under key,
+// returning its version byte, if any, and data, if plain,
+// and 1 if its MAC verifies, or 0 if it doesn't.
+// Without plain, the ciphertext is only absorbed for the MAC check.
+func (r *Reader) open(suite abstract.Suite, key, ent []byte,
+	plain bool) ([]byte, int) {
+	stream := suite.Cipher(key)
+	ctx := ent[:r.msgLen()]
+	var data []byte
+	if plain {
+		data = make([]byte, len(ctx))
+	}
+	stream.Message(data, ctx, ctx)
+	ok := 0
+	if dcipher.CheckMAC(stream, ent[len(ctx):r.entryLen()]) {
+		ok = 1
+	}
+	return data, ok
+}
+
+// Try every entrypoint offset in header under each of keys,
+// in time independent of which, if any, opens an entrypoint,
+// returning an entrypoint that opened, version byte included, if plain,
+// the index of the key that opened it, and 1, or 0 if none did.
+func (r *Reader) probe(suite abstract.Suite, keys [][]byte,
+	header []byte, plain bool) ([]byte, int, int) {
+	var data []byte
+	if plain {
+		data = make([]byte, r.msgLen())
+	}
+	idx, found := 0, 0
+	l := r.entryLen()
+	for ofs := 0; ofs+l <= len(header); ofs++ {
+		for i, key := range keys {
+			d, ok := r.open(suite, key, header[ofs:ofs+l], plain)
+			data = ctSelectBytes(ok, d, data)
+			idx = subtle.ConstantTimeSelect(ok, i, idx)
+			found |= ok
+		}
+	}
+	return data, idx, found
+}
+
+// Find and decrypt the entrypoint for the holder of priv in a header,
+// returning its data and version byte (see SetEntryVersioned()),
+// or an error if the header holds no such entrypoint.
+func (r *Reader) Read(suite abstract.Suite, priv abstract.Secret,
+	header []byte) ([]byte, byte, error) {
+	data, ver, _, err := r.ReadAny(suite, []abstract.Secret{priv}, header)
+	return data, ver, err
+}
+
+// Find and decrypt the entrypoint in a header for the holder
+// of any of several private keys of the same suite, e.g., rotated keys,
+// returning its data, version byte and the key that opened it,
+// or an error if the header holds no entrypoint for any of them.
+// Every key is tried at every offset,
+// so the time taken doesn't reveal which key matched, or where.
+func (r *Reader) ReadAny(suite abstract.Suite, privs []abstract.Secret,
+	header []byte) ([]byte, byte, abstract.Secret, error) {
+	si, err := r.suiteInfo(suite)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	keys := entryKeys(si, si.findPoint(header), privs)
+	plain, idx, found := r.probe(suite, keys, header, true)
+	if found == 0 {
+		return nil, 0, nil, errors.New("no entrypoint for suite " +
+			suite.String())
+	}
+	data, ver := r.split(plain)
+	return data, ver, privs[idx], nil
+}
+
+// Find and decrypt the entrypoint for the holder of priv
+// in a header of length hdrlen read from src, e.g., a file on disk,
+// without loading the whole header into memory, returning as Read() does.
+// The suite's point is read from its positions alone,
+// but since the Reader tries every entrypoint offset,
+// the rest of the header is still read, a window at a time.
+func (r *Reader) ReadAt(suite abstract.Suite, priv abstract.Secret,
+	src io.ReaderAt, hdrlen int) ([]byte, byte, error) {
+	si, err := r.suiteInfo(suite)
+	if err != nil {
+		return nil, 0, err
+	}
+	pnt, err := si.findPointAt(src, hdrlen)
+	if err != nil {
+		return nil, 0, err
+	}
+	keys := entryKeys(si, pnt, []abstract.Secret{priv})
+	plain := make([]byte, r.msgLen())
+	found := 0
+	l := r.entryLen()
+	win := make([]byte, readAtWindow+l-1)
+	for ofs := 0; ofs+l <= hdrlen; ofs += readAtWindow {
+		n := len(win)
+		if ofs+n > hdrlen {
+			n = hdrlen - ofs
+		}
+		if err := readAt(src, win[:n], ofs); err != nil {
+			return nil, 0, err
+		}
+		p, _, ok := r.probe(suite, keys, win[:n], true)
+		plain = ctSelectBytes(ok, p, plain)
+		found |= ok
+	}
+	if found == 0 {
+		return nil, 0, errors.New("no entrypoint for suite " +
+			suite.String())
+	}
+	data, ver := r.split(plain)
+	return data, ver, nil
+}
+
+// Find and decrypt every entrypoint for the holder of priv in a header,
+// returning their data and version bytes in order of offset,
+// or empty results if the header holds none.
+// Every offset is tried, but the result reveals how many matched.
+func (r *Reader) ReadAll(suite abstract.Suite, priv abstract.Secret,
+	header []byte) ([][]byte, []byte, error) {
+	si, err := r.suiteInfo(suite)
+	if err != nil {
+		return nil, nil, err
+	}
+	key := entryKeys(si, si.findPoint(header), []abstract.Secret{priv})[0]
+	all, vers := [][]byte{}, []byte{}
+	l := r.entryLen()
+	for ofs := 0; ofs+l <= len(header); ofs++ {
+		plain, ok := r.open(suite, key, header[ofs:ofs+l], true)
+		if ok == 1 {
+			data, ver := r.split(plain)
+			all = append(all, data)
+			vers = append(vers, ver)
+		}
+	}
+	return all, vers, nil
+}
+
+// Find which of several headers hold an entrypoint for the holder of priv,
+// e.g., for a relay receiving many headers, returning their indices.
+// The suite's point positions are derived once for all the headers,
+// each of which is checked as by HasEntry().
+// Returns nil if the Reader can't read the suite's headers at all.
+func (r *Reader) Scan(suite abstract.Suite, priv abstract.Secret,
+	headers [][]byte) []int {
+	si, err := r.suiteInfo(suite)
+	if err != nil {
+		return nil
+	}
+	privs := []abstract.Secret{priv}
+	var found []int
+	for i, header := range headers {
+		keys := entryKeys(si, si.findPoint(header), privs)
+		if _, _, ok := r.probe(suite, keys, header, false); ok == 1 {
+			found = append(found, i)
+		}
+	}
+	return found
+}
+
+// Report whether a header holds an entrypoint for the holder of priv,
+// e.g., for a client scanning many headers for ones relevant to it.
+// Like Read(), this checks the MAC at every offset in constant time,
+// but without decrypting or selecting any entrypoint data.
+// Returns false if the Reader can't read the suite's headers at all.
+func (r *Reader) HasEntry(suite abstract.Suite, priv abstract.Secret,
+	header []byte) bool {
+	si, err := r.suiteInfo(suite)
+	if err != nil {
+		return false
+	}
+	keys := entryKeys(si, si.findPoint(header), []abstract.Secret{priv})
+	_, _, found := r.probe(suite, keys, header, false)
+	return found == 1
+}
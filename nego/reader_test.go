@@ -0,0 +1,340 @@
+package nego
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/cipher/sha3"
+	"github.com/dedis/crypto/random"
+	"github.com/dedis/crypto/test"
+	"testing"
+)
+
+// Lay out and write a header with entrypoint MACs for the given inputs,
+// returning the header and a Reader configured to match the Writer,
+// knowing the level bound of every suite.
+func testReaderHeader(t testing.TB, suiteLevel map[abstract.Suite]int,
+	entries []Entry, datalen int) ([]byte, *Reader) {
+	w := Writer{}
+	w.SetEntryMACLen(DefaultEntryMACLen)
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatal(err)
+	}
+	hdr := w.Write(random.Stream)
+	r := &Reader{}
+	r.SetEntryLen(datalen)
+	r.SetEntryMACLen(DefaultEntryMACLen)
+	for suite, nlevels := range suiteLevel {
+		r.SetSuiteLevel(suite, nlevels)
+	}
+	return hdr, r
+}
+
+func TestReaderRead(t *testing.T) {
+	suiteLevel, entries, privs := testMockInputs(5, 8, 32, 16)
+	hdr, r := testReaderHeader(t, suiteLevel, entries, 16)
+	for i := range entries {
+		e := &entries[i]
+		data, _, err := r.Read(e.Suite, privs[i], hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, e.Data) {
+			t.Fatalf("entrypoint %d read as %x", i, data)
+		}
+	}
+
+	// A key the header holds no entrypoint for finds nothing.
+	suite := entries[0].Suite
+	other, _ := test.GenKeypair(suite, random.Stream)
+	if _, _, err := r.Read(suite, other, hdr); err == nil {
+		t.Fatal("Read opened an entrypoint with the wrong key")
+	}
+
+	// The Reader needs to know the suite's level and the entrypoint MACs.
+	if _, _, err := (&Reader{}).Read(suite, privs[0], hdr); err == nil {
+		t.Fatal("Read succeeded without knowing the suite's level")
+	}
+	r.SetEntryMACLen(0)
+	if _, _, err := r.Read(suite, privs[0], hdr); err == nil {
+		t.Fatal("Read succeeded without entrypoint MACs")
+	}
+}
+
+func TestReaderReadAny(t *testing.T) {
+	suiteLevel, entries, privs := testMockInputs(3, 8, 32, 16)
+	hdr, r := testReaderHeader(t, suiteLevel, entries, 16)
+	suite := entries[1].Suite
+	old1, _ := test.GenKeypair(suite, random.Stream)
+	old2, _ := test.GenKeypair(suite, random.Stream)
+	data, _, priv, err := r.ReadAny(suite,
+		[]abstract.Secret{old1, privs[1], old2}, hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, entries[1].Data) || !priv.Equal(privs[1]) {
+		t.Fatal("ReadAny found the wrong entrypoint or key")
+	}
+	if _, _, _, err := r.ReadAny(suite,
+		[]abstract.Secret{old1, old2}, hdr); err == nil {
+		t.Fatal("ReadAny opened an entrypoint with none of its keys")
+	}
+}
+
+func TestReaderUnknownSuites(t *testing.T) {
+	suiteLevel, entries, privs := testMockInputs(3, 8, 32, 16)
+	hdr, _ := testReaderHeader(t, suiteLevel, entries, 16)
+
+	// A Reader knowing only its own suite's level bound
+	// opens its entrypoint, treating the rest of the header as opaque.
+	for i := range entries {
+		e := &entries[i]
+		r := Reader{}
+		r.SetEntryLen(16)
+		r.SetEntryMACLen(DefaultEntryMACLen)
+		r.SetSuiteLevel(e.Suite, suiteLevel[e.Suite])
+		data, _, err := r.Read(e.Suite, privs[i], hdr)
+		if err != nil || !bytes.Equal(data, e.Data) {
+			t.Fatalf("entrypoint %d didn't open knowing only %s: %v",
+				i, e.Suite, err)
+		}
+	}
+}
+
+func TestReaderPositionConfig(t *testing.T) {
+	suiteLevel, entries, privs := testMockInputs(3, 8, 32, 16)
+	w := Writer{}
+	w.SetEntryMACLen(DefaultEntryMACLen)
+	w.SetPositionDomain("v2:")
+	w.SetTagEndianness(binary.LittleEndian)
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatal(err)
+	}
+	hdr := w.Write(random.Stream)
+	r := Reader{}
+	r.SetEntryLen(16)
+	r.SetEntryMACLen(DefaultEntryMACLen)
+	r.SetPositionDomain("v2:")
+	r.SetTagEndianness(binary.LittleEndian)
+	for suite, nlevels := range suiteLevel {
+		r.SetSuiteLevel(suite, nlevels)
+	}
+	e := &entries[0]
+	if data, _, err := r.Read(e.Suite, privs[0], hdr); err != nil ||
+		!bytes.Equal(data, e.Data) {
+		t.Fatalf("entrypoint didn't open under the Writer's "+
+			"domain and tag byte order: %v", err)
+	}
+}
+
+func TestReaderPositionHash(t *testing.T) {
+	fixed := func(seed []byte) cipher.Stream {
+		return sha3.NewShakeCipher256(seed)
+	}
+	suiteLevel, entries, privs := testMockInputs(3, 8, 32, 16)
+	w := Writer{}
+	w.SetEntryMACLen(DefaultEntryMACLen)
+	w.SetPositionHash(fixed)
+	if _, err := w.Layout(suiteLevel, entries, random.Stream); err != nil {
+		t.Fatal(err)
+	}
+	hdr := w.Write(random.Stream)
+	r := Reader{}
+	r.SetEntryLen(16)
+	r.SetEntryMACLen(DefaultEntryMACLen)
+	for suite, nlevels := range suiteLevel {
+		r.SetSuiteLevel(suite, nlevels)
+	}
+
+	// Only a Reader using the Writer's hash finds the points.
+	e := &entries[0]
+	if _, _, err := r.Read(e.Suite, privs[0], hdr); err == nil {
+		t.Fatal("entrypoint opened without the Writer's position hash")
+	}
+	r.SetPositionHash(fixed)
+	if data, _, err := r.Read(e.Suite, privs[0], hdr); err != nil ||
+		!bytes.Equal(data, e.Data) {
+		t.Fatalf("entrypoint didn't open under the Writer's "+
+			"position hash: %v", err)
+	}
+}
+
+func TestReaderReadAt(t *testing.T) {
+	// Entrypoints longer than ReadAt's window must straddle windows.
+	datalen := readAtWindow + 100
+	suiteLevel, entries, privs := testMockInputs(3, 8, 32, datalen)
+	hdr, r := testReaderHeader(t, suiteLevel, entries, datalen)
+	src := bytes.NewReader(hdr)
+	for i := range entries {
+		e := &entries[i]
+		data, _, err := r.ReadAt(e.Suite, privs[i], src, len(hdr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, e.Data) {
+			t.Fatalf("entrypoint %d read as %x", i, data)
+		}
+	}
+	suite := entries[0].Suite
+	other, _ := test.GenKeypair(suite, random.Stream)
+	if _, _, err := r.ReadAt(suite, other, src, len(hdr)); err == nil {
+		t.Fatal("ReadAt opened an entrypoint with the wrong key")
+	}
+
+	// A source shorter than the claimed header length is an error.
+	short := bytes.NewReader(hdr[:len(hdr)/2])
+	if _, _, err := r.ReadAt(suite, privs[0], short, len(hdr)); err == nil {
+		t.Fatal("ReadAt succeeded on a truncated source")
+	}
+}
+
+func TestReaderEntryVersion(t *testing.T) {
+	suiteLevel, entries, privs := testMockInputs(3, 8, 32, 16)
+	e := &entries[0]
+
+	// The Reader knows no versions, so surfaces every one it reads.
+	for _, version := range []byte{1, 0xff} {
+		w := Writer{}
+		w.SetEntryMACLen(DefaultEntryMACLen)
+		w.SetEntryVersion(version)
+		if _, err := w.Layout(suiteLevel, entries,
+			random.Stream); err != nil {
+			t.Fatal(err)
+		}
+		hdr := w.Write(random.Stream)
+		r := Reader{}
+		r.SetEntryLen(16)
+		r.SetEntryMACLen(DefaultEntryMACLen)
+		r.SetSuiteLevel(e.Suite, suiteLevel[e.Suite])
+		if _, _, err := r.Read(e.Suite, privs[0], hdr); err == nil {
+			t.Fatal("versioned entrypoint opened as unversioned")
+		}
+		r.SetEntryVersioned(true)
+		data, ver, err := r.Read(e.Suite, privs[0], hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ver != version || !bytes.Equal(data, e.Data) {
+			t.Fatalf("entrypoint read as version %d, data %x",
+				ver, data)
+		}
+		_, vers, err := r.ReadAll(e.Suite, privs[0], hdr)
+		if err != nil || len(vers) != 1 || vers[0] != version {
+			t.Fatalf("ReadAll found versions %v: %v", vers, err)
+		}
+	}
+}
+
+func TestReaderHasEntry(t *testing.T) {
+	suiteLevel, entries, privs := testMockInputs(3, 8, 32, 16)
+	hdr, r := testReaderHeader(t, suiteLevel, entries, 16)
+	for i := range entries {
+		if !r.HasEntry(entries[i].Suite, privs[i], hdr) {
+			t.Fatalf("no entrypoint %d found", i)
+		}
+	}
+	suite := entries[0].Suite
+	other, _ := test.GenKeypair(suite, random.Stream)
+	if r.HasEntry(suite, other, hdr) {
+		t.Fatal("found an entrypoint for the wrong key")
+	}
+	if (&Reader{}).HasEntry(suite, privs[0], hdr) {
+		t.Fatal("found an entrypoint without knowing the suite's level")
+	}
+}
+
+func TestReaderReadAll(t *testing.T) {
+	suiteLevel, entries, privs := testMockInputs(3, 8, 32, 16)
+
+	// Give the first key a second entrypoint.
+	e := entries[0]
+	e.Data = random.Bytes(16, random.Stream)
+	entries = append(entries, e)
+	hdr, r := testReaderHeader(t, suiteLevel, entries, 16)
+	all, _, err := r.ReadAll(e.Suite, privs[0], hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 {
+		t.Fatalf("ReadAll found %d entrypoints, want 2", len(all))
+	}
+	for _, want := range [][]byte{entries[0].Data, e.Data} {
+		if !bytes.Equal(all[0], want) && !bytes.Equal(all[1], want) {
+			t.Fatalf("ReadAll didn't find entrypoint data %x", want)
+		}
+	}
+
+	// A key with no entrypoints finds an empty result, not an error.
+	other, _ := test.GenKeypair(e.Suite, random.Stream)
+	if all, _, err := r.ReadAll(e.Suite, other, hdr); err != nil ||
+		all == nil || len(all) != 0 {
+		t.Fatalf("ReadAll for the wrong key: %v, %v", all, err)
+	}
+}
+
+func TestReaderScan(t *testing.T) {
+	suiteLevel, entries, privs := testMockInputs(3, 8, 32, 16)
+	hdr, r := testReaderHeader(t, suiteLevel, entries[1:], 16)
+	without := hdr
+	hdr, _ = testReaderHeader(t, suiteLevel, entries, 16)
+	headers := [][]byte{without, hdr, without, hdr}
+	found := r.Scan(entries[0].Suite, privs[0], headers)
+	if len(found) != 2 || found[0] != 1 || found[1] != 3 {
+		t.Fatalf("Scan found entrypoints in headers %v, want [1 3]",
+			found)
+	}
+	if found := r.Scan(entries[1].Suite, privs[1], headers); len(found) != 4 {
+		t.Fatalf("Scan found entrypoints in headers %v, want all", found)
+	}
+}
+
+// Benchmark opening an entrypoint in a header with a moderate number
+// of suites, deriving positions, doing the DH and checking MACs,
+// for a key the header holds or, if !present, one it doesn't.
+// Every offset is probed either way, so the two should cost about the same.
+func benchmarkReaderRead(b *testing.B, present bool) {
+	suiteLevel, entries, privs := testLayoutInputs(10, 8, 16)
+	hdr, r := testReaderHeader(b, suiteLevel, entries, 16)
+	e := &entries[0]
+	priv := privs[0]
+	if !present {
+		priv, _ = test.GenKeypair(e.Suite, random.Stream)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Read(e.Suite, priv, hdr)
+	}
+}
+
+func BenchmarkReaderRead(b *testing.B)       { benchmarkReaderRead(b, true) }
+func BenchmarkReaderReadAbsent(b *testing.B) { benchmarkReaderRead(b, false) }
+
+// Benchmark finding which of several headers hold a key's entrypoint,
+// via Scan() or by calling Read() on each header.
+func benchmarkReaderScan(b *testing.B, scan bool) {
+	suiteLevel, entries, privs := testLayoutInputs(5, 8, 16)
+	var headers [][]byte
+	var r *Reader
+	for i := 0; i < 8; i++ {
+		var hdr []byte
+		hdr, r = testReaderHeader(b, suiteLevel, entries, 16)
+		headers = append(headers, hdr)
+	}
+	e := &entries[0]
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if scan {
+			r.Scan(e.Suite, privs[0], headers)
+			continue
+		}
+		for _, hdr := range headers {
+			r.Read(e.Suite, privs[0], hdr)
+		}
+	}
+}
+
+func BenchmarkReaderScan(b *testing.B)     { benchmarkReaderScan(b, true) }
+func BenchmarkReaderReadLoop(b *testing.B) { benchmarkReaderScan(b, false) }
@@ -31,10 +31,46 @@ type skipNode struct {
 // and operation would probably be much more efficient if we did.
 type skipLayout struct {
 	head []*skipNode
+	nodes []skipNode	// preallocated node pool, see grow()
+	nused int		// number of pool nodes in use
+	ptrs []*skipNode	// preallocated successor pointer pool
+	pused int		// number of pool pointers in use
 }
 
 func (sl *skipLayout) reset() {
 	sl.head = make([]*skipNode, 1)		// minimum stack height
+	sl.nused = 0				// nothing references pool now
+	sl.pused = 0
+}
+
+// Preallocate a pool of nodes for about n reservations,
+// to avoid allocating each node individually as it is inserted.
+// Once the pool is exhausted, nodes are allocated individually again.
+func (sl *skipLayout) grow(n int) {
+	if n > len(sl.nodes) {
+		sl.nodes = make([]skipNode, n)
+		sl.ptrs = make([]*skipNode, 2*n)	// mean node height is 2
+		sl.nused = 0
+		sl.pused = 0
+	}
+}
+
+// Obtain a new node with a given stack height, from the pool if possible.
+func (sl *skipLayout) newNode(height int) *skipNode {
+	var n *skipNode
+	if sl.nused < len(sl.nodes) {
+		n = &sl.nodes[sl.nused]
+		sl.nused++
+	} else {
+		n = &skipNode{}
+	}
+	if sl.pused+height <= len(sl.ptrs) {
+		n.suc = sl.ptrs[sl.pused:sl.pused+height:sl.pused+height]
+		sl.pused += height
+	} else {
+		n.suc = make([]*skipNode, height)
+	}
+	return n
 }
 
 // Create a new skip-list iterator.
@@ -72,8 +108,9 @@ func (sl *skipLayout) find(ofs int) []**skipNode {
 func (sl *skipLayout) insert(pos []**skipNode, lo,hi int,
 				name string) []**skipNode {
 
-	nsuc := make([]*skipNode,skipHeight())
-	n := skipNode{lo,hi,nsuc,name}
+	n := sl.newNode(skipHeight())
+	n.lo, n.hi, n.name = lo, hi, name
+	nsuc := n.suc
 
 	// Insert the new node at all appropriate levels
 	for i := range(nsuc) {
@@ -83,7 +120,7 @@ func (sl *skipLayout) insert(pos []**skipNode, lo,hi int,
 			pos = append(pos, &sl.head[i])
 		}
 		nsuc[i] = *pos[i]
-		*pos[i] = &n
+		*pos[i] = n
 		pos[i] = &nsuc[i]
 	}
 	return pos
@@ -136,12 +173,35 @@ func (sl *skipLayout) reserve(lo,hi int, excl bool, name string) bool {
 	return gotExcl
 }
 
+// Return true if any part of the extent from lo to hi is already reserved.
+func (sl *skipLayout) overlaps(lo,hi int) bool {
+	suc := *sl.find(lo)[0]
+	return suc != nil && suc.lo < hi
+}
+
+// Return the name of the first reservation overlapping the extent lo to hi,
+// or the empty string if no part of the extent is reserved.
+func (sl *skipLayout) owner(lo,hi int) string {
+	suc := *sl.find(lo)[0]
+	if suc == nil || suc.lo >= hi {
+		return ""
+	}
+	return suc.name
+}
+
 // Find and reserve the first available l-byte region in the layout.
 func (sl *skipLayout) alloc(l int, name string) int {
+	return sl.allocAlign(l, 1, name)
+}
+
+// Find and reserve the first available l-byte region in the layout
+// starting at a multiple of align bytes.
+func (sl *skipLayout) allocAlign(l, align int, name string) int {
 
 	pos := sl.iter()
 	ofs := 0
 	for {	// Find a position to insert
+		ofs = (ofs + align-1) / align * align
 		suc := *pos[0]
 		if suc == nil {
 			break	// no more reservations; definitely room here!
@@ -181,6 +241,33 @@ func (sl *skipLayout) scanFree(f func(int,int), max int) {
 	}
 }
 
+// Return all reservations in the layout, in order of offset.
+func (sl *skipLayout) ranges() []Reservation {
+	var r []Reservation
+	if sl.head == nil {
+		return r
+	}
+	for n := sl.head[0]; n != nil; n = n.suc[0] {
+		r = append(r, Reservation{n.lo, n.hi, n.name})
+	}
+	return r
+}
+
+// Return an independent copy of the layout with the same reservations,
+// so that reserving regions in either doesn't affect the other.
+func (sl *skipLayout) clone() skipLayout {
+	c := skipLayout{}
+	if sl.head == nil {
+		return c
+	}
+	c.reset()
+	pos := c.iter()
+	for n := sl.head[0]; n != nil; n = n.suc[0] {
+		pos = c.insert(pos, n.lo, n.hi, n.name)
+	}
+	return c
+}
+
 func (sl *skipLayout) dump() {
 
 	pos := make([]**skipNode, len(sl.head))
@@ -0,0 +1,20 @@
+package nego
+
+import (
+	"crypto/subtle"
+)
+
+// Return a copy of a if cond == 1, or a copy of b if cond == 0,
+// taking time independent of cond.
+// The slices a and b must have equal length.
+// Used to select among candidate decryption results
+// without branching on which candidate's MAC verified.
+func ctSelectBytes(cond int, a, b []byte) []byte {
+	if len(a) != len(b) {
+		panic("ctSelectBytes: slices of unequal length")
+	}
+	r := make([]byte, len(b))
+	copy(r, b)
+	subtle.ConstantTimeCopy(cond, r, a)
+	return r
+}
@@ -0,0 +1,20 @@
+package nego
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCtSelectBytes(t *testing.T) {
+	a := []byte{1, 2, 3, 4}
+	b := []byte{5, 6, 7, 8}
+	if r := ctSelectBytes(1, a, b); !bytes.Equal(r, a) {
+		t.Fatalf("cond 1 selected %v", r)
+	}
+	if r := ctSelectBytes(0, a, b); !bytes.Equal(r, b) {
+		t.Fatalf("cond 0 selected %v", r)
+	}
+	if r := ctSelectBytes(1, nil, nil); len(r) != 0 {
+		t.Fatalf("empty selection yielded %v", r)
+	}
+}
@@ -4,11 +4,16 @@ import (
 	"bytes"
 	"crypto/cipher"
 	"crypto/rand"
+	"encoding"
 	"github.com/dedis/crypto/abstract"
-	"github.com/dedis/crypto/subtle"
+	dcipher "github.com/dedis/crypto/cipher"
 	"hash"
 	"math"
+	"os"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 )
 
 func HashBench(b *testing.B, hash func() hash.Hash) {
@@ -23,6 +28,52 @@ func HashBench(b *testing.B, hash func() hash.Hash) {
 	}
 }
 
+// Benchmark an abstract.Cipher used as a hash function,
+// absorbing 1MB of input and then squeezing out HashSize() bytes,
+// for comparison against a dedicated hash.Hash via HashBench.
+func CipherHashBench(b *testing.B,
+	newCipher func([]byte, ...interface{}) abstract.Cipher) {
+	b.SetBytes(1024 * 1024)
+	data := make([]byte, 1024)
+	sum := make([]byte, newCipher(abstract.NoKey).HashSize())
+	for i := 0; i < b.N; i++ {
+		c := newCipher(abstract.NoKey)
+		for j := 0; j < 1024; j++ {
+			c.Partial(nil, nil, data)
+		}
+		c.Message(nil, nil, nil)
+		c.Partial(sum, nil, nil)
+	}
+}
+
+// Benchmark several named message Ciphers side by side,
+// running a sub-benchmark for each that encrypts a 1MB message
+// via the full Message path and then produces its MAC,
+// so that "go test -bench" produces a directly comparable table.
+func BenchmarkCiphers(b *testing.B,
+	ciphers map[string]func([]byte, ...interface{}) abstract.Cipher) {
+	names := make([]string, 0, len(ciphers))
+	for name := range ciphers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		newCipher := ciphers[name]
+		b.Run(name, func(b *testing.B) {
+			key := make([]byte, newCipher(nil).KeySize())
+			data := make([]byte, 1024*1024)
+			mac := make([]byte, newCipher(nil).HashSize())
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c := newCipher(key)
+				c.Message(data, data, data)
+				c.Message(mac, nil, nil)
+			}
+		})
+	}
+}
+
 // Benchmark a stream cipher.
 func StreamCipherBench(b *testing.B, keylen int,
 	cipher func([]byte) cipher.Stream) {
@@ -37,6 +88,19 @@ func StreamCipherBench(b *testing.B, keylen int,
 	}
 }
 
+// Benchmark only the construction of an abstract.Cipher from a keylen-byte key,
+// including any key scheduling, without encrypting anything,
+// to separate setup cost from throughput for protocols that rekey often.
+func CipherSetupBench(b *testing.B, keylen int,
+	newCipher func([]byte, ...interface{}) abstract.Cipher) {
+	key := make([]byte, keylen)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		newCipher(key)
+	}
+}
+
 // Benchmark a block cipher operating in counter mode.
 /*
 XXX Broken
@@ -50,6 +114,40 @@ func BlockCipherBench(b *testing.B, keylen int,
 }
 */
 
+// Wrap a Cipher constructor so that it panics
+// if the same non-nil key is ever passed to it twice,
+// to catch tests or protocols that accidentally reuse a key
+// (or fail to rotate a nonce) across messages.
+// Only the constructor used for encryption should be wrapped,
+// since decryption legitimately reuses the encryption key.
+// A nil key requests a fresh random key, and is always permitted.
+func OnceKey(newCipher func([]byte, ...interface{}) abstract.Cipher) func(
+	[]byte, ...interface{}) abstract.Cipher {
+	var mutex sync.Mutex
+	used := make(map[string]bool)
+	return func(key []byte, options ...interface{}) abstract.Cipher {
+		if key != nil {
+			mutex.Lock()
+			reused := used[string(key)]
+			used[string(key)] = true
+			mutex.Unlock()
+			if reused {
+				panic("key reused")
+			}
+		}
+		return newCipher(key, options...)
+	}
+}
+
+// Check in constant time that a received MAC is the one
+// the Cipher c produces next, as with c.Message(mac, nil, nil),
+// by delegating to CheckMAC in github.com/dedis/crypto/cipher.
+// Returns true if the MAC verifies. The received slice is left unmodified,
+// but the state of c is advanced as by a Message call.
+func VerifyMAC(c abstract.Cipher, received []byte) bool {
+	return dcipher.CheckMAC(c, received)
+}
+
 // Compares the bits between two arrays returning the fraction
 // of differences. If the two arrays are not of the same length
 // no comparison is made and a -1 is returned.
@@ -98,6 +196,78 @@ func BitDiff(a, b []byte) float64 {
 	return float64(count) / float64(len(a)*8)
 }
 
+// Tolerated chance that a single BitDiff comparison in these tests fails
+// even though the ciphertexts are independent and uniformly random.
+const bitDiffFalseRate = 1e-6
+
+// Returns the probability that two independent, uniformly random
+// nbytes-byte strings have a BitDiff below bitdiff,
+// i.e., the rate at which a BitDiff check fails a perfect cipher.
+// For short strings this is far from negligible:
+// the number of differing bits is binomially distributed around half,
+// so a 12-byte string falls below 0.35 about once in 700 comparisons.
+func BitDiffFalseRate(nbytes int, bitdiff float64) float64 {
+	nbits := nbytes * 8
+	rate := 0.0
+	for k := 0; float64(k) < bitdiff*float64(nbits); k++ {
+		rate += binomialHalf(nbits, k)
+	}
+	return rate
+}
+
+// Returns a BitDiff threshold for nbytes-byte strings:
+// bitdiff itself if it yields a false failure rate of at most rate,
+// or else the highest lower threshold that does.
+func BitDiffThreshold(nbytes int, bitdiff, rate float64) float64 {
+	nbits := nbytes * 8
+	if nbits == 0 {
+		return bitdiff
+	}
+
+	// Hoeffding's bound settles long strings without summing.
+	dev := 0.5 - bitdiff
+	if dev > 0 && math.Exp(-2*float64(nbits)*dev*dev) <= rate {
+		return bitdiff
+	}
+
+	// Find the lowest count of differing bits that fails too often.
+	cum := 0.0
+	for k := 0; k < nbits; k++ {
+		cum += binomialHalf(nbits, k)
+		if cum > rate {
+			return math.Min(bitdiff, float64(k)/float64(nbits))
+		}
+	}
+	return bitdiff
+}
+
+// Returns the probability of exactly k successes in n fair coin flips.
+func binomialHalf(n, k int) float64 {
+	lnN, _ := math.Lgamma(float64(n + 1))
+	lnK, _ := math.Lgamma(float64(k + 1))
+	lnNK, _ := math.Lgamma(float64(n - k + 1))
+	return math.Exp(lnN - lnK - lnNK - float64(n)*math.Ln2)
+}
+
+// Compares the bytes between two arrays returning the fraction
+// of bytes that differ, a coarser but cheaper check than BitDiff.
+// If the two arrays are not of the same length
+// no comparison is made and a -1 is returned.
+func ByteDiff(a, b []byte) float64 {
+	if len(a) != len(b) {
+		return -1
+	}
+
+	count := 0
+	for i := 0; i < len(a); i++ {
+		if a[i] != b[i] {
+			count += 1
+		}
+	}
+
+	return float64(count) / float64(len(a))
+}
+
 // Tests a Cipher can encrypt and decrypt
 func BCHelloWorldHelper(t *testing.T,
 	newCipher func([]byte, ...interface{}) abstract.Cipher,
@@ -105,6 +275,7 @@ func BCHelloWorldHelper(t *testing.T,
 	text := []byte("Hello, World")
 	cryptsize := len(text)
 	decrypted := make([]byte, len(text))
+	bitdiff = BitDiffThreshold(cryptsize, bitdiff, bitDiffFalseRate)
 
 	bc := newCipher(nil)
 	keysize := bc.KeySize()
@@ -158,7 +329,6 @@ func AuthenticateAndEncrypt(t *testing.T,
 	bc := newCipher(nil)
 	keysize := bc.KeySize()
 	hashsize := bc.HashSize()
-	mac := make([]byte, hashsize)
 
 	nciphers := make([]abstract.Cipher, n)
 	ncrypts := make([][]byte, n)
@@ -182,9 +352,7 @@ func AuthenticateAndEncrypt(t *testing.T,
 			t.FailNow()
 		}
 
-		mac = make([]byte, hashsize)
-		bc.Message(nmacs[i], mac, nil)
-		if subtle.ConstantTimeAllEq(mac, 0) != 1 {
+		if !VerifyMAC(bc, nmacs[i]) {
 			t.Log("MAC Check failed")
 			t.FailNow()
 		}
@@ -198,10 +366,8 @@ func AuthenticateAndEncrypt(t *testing.T,
 			}
 			bc = newCipher(nkeys[i])
 			bc.Message(decrypted, ncrypts[j], ncrypts[j])
-			mac = make([]byte, hashsize)
-			bc.Message(nmacs[j], mac, nil)
-			if subtle.ConstantTimeAllEq(mac, 0) != 1 {
-				t.Log("MAC Check failed")
+			if VerifyMAC(bc, nmacs[j]) {
+				t.Log("MAC Check passed with different key")
 				t.FailNow()
 			}
 		}
@@ -213,6 +379,7 @@ func AuthenticateAndEncrypt(t *testing.T,
 	}
 
 	// Bit difference test
+	bitdiff = BitDiffThreshold(cryptsize, bitdiff, bitDiffFalseRate)
 	for i := range ncrypts {
 		for j := i + 1; j < len(ncrypts); j++ {
 			res := BitDiff(ncrypts[i], ncrypts[j])
@@ -227,14 +394,16 @@ func AuthenticateAndEncrypt(t *testing.T,
 
 	// Bit flipping test
 	for i := range ncrypts {
-		copy(ncrypts[i], deltacopy)
+		copy(deltacopy, ncrypts[i])
+		if !bytes.Equal(deltacopy, ncrypts[i]) {
+			t.Log("Bit flipping test not starting from ciphertext")
+			t.FailNow()
+		}
 
 		deltacopy[0] ^= 255
 		bc = newCipher(nkeys[i])
 		bc.Message(decrypted, deltacopy, deltacopy)
-		mac = make([]byte, hashsize)
-		bc.Message(nmacs[i], mac, nil)
-		if subtle.ConstantTimeAllEq(mac, 0) != 1 {
+		if VerifyMAC(bc, nmacs[i]) {
 			t.Log("MAC Check passed")
 			t.FailNow()
 		}
@@ -243,9 +412,7 @@ func AuthenticateAndEncrypt(t *testing.T,
 		deltacopy[len(deltacopy)/2-1] ^= 255
 		bc = newCipher(nkeys[i])
 		bc.Message(decrypted, deltacopy, deltacopy)
-		mac = make([]byte, hashsize)
-		bc.Message(nmacs[i], mac, nil)
-		if subtle.ConstantTimeAllEq(mac, 0) != 1 {
+		if VerifyMAC(bc, nmacs[i]) {
 			t.Log("MAC Check passed")
 			t.FailNow()
 		}
@@ -254,27 +421,54 @@ func AuthenticateAndEncrypt(t *testing.T,
 		deltacopy[len(deltacopy)-1] ^= 255
 		bc = newCipher(nkeys[i])
 		bc.Message(decrypted, deltacopy, deltacopy)
-		mac = make([]byte, hashsize)
-		bc.Message(nmacs[i], mac, nil)
-		if subtle.ConstantTimeAllEq(mac, 0) != 1 {
+		if VerifyMAC(bc, nmacs[i]) {
 			t.Log("MAC Check passed")
 			t.FailNow()
 		}
 
 		deltamac := make([]byte, hashsize)
-		copy(nmacs[i], deltamac)
+		copy(deltamac, nmacs[i])
 		deltamac[0] ^= 255
 		bc = newCipher(nkeys[i])
 		bc.Message(decrypted, ncrypts[i], ncrypts[i])
-		mac = make([]byte, hashsize)
-		bc.Message(deltamac, mac, nil)
-		if subtle.ConstantTimeAllEq(mac, 0) != 1 {
+		if VerifyMAC(bc, deltamac) {
 			t.Log("MAC Check passed")
 			t.FailNow()
 		}
 	}
 }
 
+// Tests that the MAC covers every byte of an encrypted message,
+// not just a prefix or a sampling of positions:
+// flipping a bit at any position of the ciphertext makes the MAC check fail.
+// The flipped bit varies with the position, so all bit positions get tested.
+// A message of a few blocks suffices, as each position needs its own check.
+func MACCoverageTest(t *testing.T,
+	newCipher func([]byte, ...interface{}) abstract.Cipher,
+	text []byte) {
+	keysize := newCipher(nil).KeySize()
+	key := make([]byte, keysize)
+	rand.Read(key)
+
+	c := newCipher(key)
+	crypt := make([]byte, len(text))
+	c.Message(crypt, text, crypt)
+	mac := make([]byte, c.HashSize())
+	c.Message(mac, nil, nil)
+
+	decrypted := make([]byte, len(text))
+	for i := range crypt {
+		crypt[i] ^= 1 << uint(i%8)
+		c = newCipher(key)
+		c.Message(decrypted, crypt, crypt)
+		if VerifyMAC(c, mac) {
+			t.Log("MAC Check passed with byte", i, "modified")
+			t.FailNow()
+		}
+		crypt[i] ^= 1 << uint(i%8)
+	}
+}
+
 func CipherPRNG(t *testing.T,
 	newCipher func([]byte, ...interface{}) abstract.Cipher,
 	randdiff float64) {
@@ -326,6 +520,49 @@ func PartialTest(t *testing.T,
 	}
 }
 
+// Tests that absorbing associated data and then encrypting text,
+// both in 8-byte chunks via Partial, yields the same ciphertext and MAC
+// as absorbing the associated data and encrypting the text
+// with one Message call each.
+func PartialADMACTest(t *testing.T,
+	newCipher func([]byte, ...interface{}) abstract.Cipher,
+	ad, text []byte) {
+	bc := newCipher(nil)
+	key := make([]byte, bc.KeySize())
+	rand.Read(key)
+	mac1 := make([]byte, bc.HashSize())
+	mac2 := make([]byte, bc.HashSize())
+	dst1 := make([]byte, len(text))
+	dst2 := make([]byte, len(text))
+
+	bc = newCipher(key)
+	bc.Message(nil, nil, ad)
+	bc.Message(dst1, text, dst1)
+	bc.Message(mac1, nil, nil)
+
+	bc = newCipher(key)
+	i := 0
+	for ; i+8 < len(ad); i += 8 {
+		bc.Partial(nil, nil, ad[i:i+8])
+	}
+	bc.Message(nil, nil, ad[i:])
+	i = 0
+	for ; i+8 < len(text); i += 8 {
+		bc.Partial(dst2[i:i+8], text[i:i+8], dst2[i:i+8])
+	}
+	bc.Message(dst2[i:], text[i:], dst2[i:])
+	bc.Message(mac2, nil, nil)
+
+	if !bytes.Equal(dst1, dst2) {
+		t.Log("Partial != Message with associated data")
+		t.FailNow()
+	}
+	if !bytes.Equal(mac1, mac2) {
+		t.Log("Partial MAC != Message MAC with associated data")
+		t.FailNow()
+	}
+}
+
 // Iterate through various sized messages and verify
 // that encryption and authentication work
 func BCAuthenticatedEncryptionHelper(t *testing.T,
@@ -347,7 +584,196 @@ func BCAuthenticatedEncryptionHelper(t *testing.T,
 		AuthenticateAndEncrypt(t, newCipher, n, bitdiff, messages[i])
 	}
 	PartialTest(t, newCipher, messages[3])
+	PartialADMACTest(t, newCipher, []byte("associated header"), messages[3])
+	InPlaceDecryptTest(t, newCipher, messages[3])
+	MACCoverageTest(t, newCipher, messages[3])
 	MultipleMessages(t, newCipher, messages)
+	SmallMessageTest(t, newCipher)
+	MessageAliasTest(t, newCipher)
+}
+
+// Tests the aliasing patterns of Message's arguments that callers rely on,
+// as MultipleMessages does:
+// 1) Encrypting with dst as the key, Message(ct, msg, ct), authenticates ct
+// 2) Decrypting with src as the key, Message(pt, ct, ct), works the same
+// as decrypting with a separate copy of the ciphertext as the key
+// Decrypting in place, with dst aliasing the key, is not supported,
+// since the key is absorbed only after dst is written.
+func MessageAliasTest(t *testing.T,
+	newCipher func([]byte, ...interface{}) abstract.Cipher) {
+	keysize := newCipher(nil).KeySize()
+	key := make([]byte, keysize)
+	rand.Read(key)
+
+	for _, size := range []int{1, 16, 100, 1000} {
+		msg := make([]byte, size)
+		rand.Read(msg)
+		c := newCipher(key)
+		ct := make([]byte, size)
+		c.Message(ct, msg, ct)
+		mac := make([]byte, c.HashSize())
+		c.Message(mac, nil, nil)
+
+		aliased := make([]byte, size)
+		c = newCipher(key)
+		c.Message(aliased, ct, ct)
+		if !bytes.Equal(aliased, msg) || !VerifyMAC(c, mac) {
+			t.Log("Decryption with aliased src and key fails, size",
+				size)
+			t.FailNow()
+		}
+
+		separate := make([]byte, size)
+		c = newCipher(key)
+		c.Message(separate, ct, append([]byte{}, ct...))
+		if !bytes.Equal(separate, msg) || !VerifyMAC(c, mac) {
+			t.Log("Decryption with separate src and key fails, size",
+				size)
+			t.FailNow()
+		}
+	}
+}
+
+// Tests that decrypting in place, with dst aliasing the ciphertext src,
+// recovers the plaintext and verifies the MAC
+// just like decrypting into a fresh buffer,
+// as applications do to avoid allocating a second buffer.
+// The key argument must still be a separate copy of the ciphertext:
+// as MessageAliasTest notes, dst may not alias the key.
+func InPlaceDecryptTest(t *testing.T,
+	newCipher func([]byte, ...interface{}) abstract.Cipher,
+	text []byte) {
+	keysize := newCipher(nil).KeySize()
+	key := make([]byte, keysize)
+	rand.Read(key)
+
+	c := newCipher(key)
+	ct := make([]byte, len(text))
+	c.Message(ct, text, ct)
+	mac := make([]byte, c.HashSize())
+	c.Message(mac, nil, nil)
+
+	fresh := make([]byte, len(ct))
+	c = newCipher(key)
+	c.Message(fresh, ct, ct)
+	if !bytes.Equal(fresh, text) || !VerifyMAC(c, mac) {
+		t.Log("Out-of-place decryption fails")
+		t.FailNow()
+	}
+
+	inplace := append([]byte{}, ct...)
+	c = newCipher(key)
+	c.Message(inplace, inplace, ct)
+	if !bytes.Equal(inplace, text) {
+		t.Log("In-place decryption differs from out-of-place")
+		t.FailNow()
+	}
+	if !VerifyMAC(c, mac) {
+		t.Log("In-place decryption fails MAC check")
+		t.FailNow()
+	}
+}
+
+// Tests authenticated encryption of empty and single-byte plaintexts,
+// which AuthenticateAndEncrypt exempts from its randomness checks,
+// along with associated data absorbed ahead of the plaintext:
+// 1) The MAC verifies and the plaintext round-trips
+// 2) Tampering with the associated data makes the MAC check fail
+// 3) Tampering with the ciphertext makes the MAC check fail
+// 4) Decrypting under a different key makes the MAC check fail
+// An empty plaintext thus still authenticates a header with no body.
+func SmallMessageTest(t *testing.T,
+	newCipher func([]byte, ...interface{}) abstract.Cipher) {
+	keysize := newCipher(nil).KeySize()
+	key := make([]byte, keysize)
+	rand.Read(key)
+	ad := []byte("associated header")
+
+	for _, text := range [][]byte{{}, {'a'}} {
+		c := newCipher(key)
+		c.Message(nil, nil, ad)
+		crypt := make([]byte, len(text))
+		c.Message(crypt, text, crypt)
+		mac := make([]byte, c.HashSize())
+		c.Message(mac, nil, nil)
+
+		verify := func(key, ad, crypt []byte) bool {
+			c := newCipher(key)
+			c.Message(nil, nil, ad)
+			decrypted := make([]byte, len(crypt))
+			c.Message(decrypted, crypt, crypt)
+			return VerifyMAC(c, mac) && bytes.Equal(decrypted, text)
+		}
+		if !verify(key, ad, crypt) {
+			t.Log("MAC Check failed for length", len(text))
+			t.FailNow()
+		}
+
+		badad := append([]byte{}, ad...)
+		badad[0] ^= 1
+		if verify(key, badad, crypt) {
+			t.Log("Tampered associated data passed MAC check, length",
+				len(text))
+			t.FailNow()
+		}
+
+		if len(crypt) > 0 {
+			badcrypt := append([]byte{}, crypt...)
+			badcrypt[0] ^= 1
+			if verify(key, ad, badcrypt) {
+				t.Log("Tampered ciphertext passed MAC check")
+				t.FailNow()
+			}
+		}
+
+		otherkey := make([]byte, keysize)
+		rand.Read(otherkey)
+		if verify(otherkey, ad, crypt) {
+			t.Log("Different key passed MAC check, length", len(text))
+			t.FailNow()
+		}
+	}
+}
+
+// Encrypt and decrypt a message of totalBytes bytes in 64KB chunks
+// via Partial, verifying the decrypted chunks and the final MAC,
+// without ever holding the whole message or ciphertext in memory.
+func LargeStreamTest(t *testing.T,
+	newCipher func([]byte, ...interface{}) abstract.Cipher,
+	totalBytes int64) {
+	const chunk = 64 * 1024
+	bc := newCipher(nil)
+	key := make([]byte, bc.KeySize())
+	rand.Read(key)
+	enc := newCipher(key)
+	dec := newCipher(key)
+
+	text := make([]byte, chunk)
+	crypt := make([]byte, chunk)
+	decrypted := make([]byte, chunk)
+	for rem := totalBytes; rem > 0; rem -= chunk {
+		n := chunk
+		if rem < chunk {
+			n = int(rem)
+		}
+		rand.Read(text[:n])
+		enc.Partial(crypt[:n], text[:n], crypt[:n])
+		dec.Partial(decrypted[:n], crypt[:n], crypt[:n])
+		if !bytes.Equal(text[:n], decrypted[:n]) {
+			t.Log("Encryption / Decryption failed at offset",
+				totalBytes-rem)
+			t.FailNow()
+		}
+	}
+
+	mac := make([]byte, bc.HashSize())
+	enc.Message(nil, nil, nil)
+	enc.Message(mac, nil, nil)
+	dec.Message(nil, nil, nil)
+	if !VerifyMAC(dec, mac) {
+		t.Log("Invalid MAC")
+		t.FailNow()
+	}
 }
 
 func MultipleMessages(t *testing.T,
@@ -375,10 +801,8 @@ func MultipleMessages(t *testing.T,
 	bc = newCipher(key)
 	for i := 0; i < len(messages); i++ {
 		decrypted := make([]byte, len(messages[i]))
-		macResult := make([]byte, hashsize)
 		bc.Message(decrypted, encrypted[i], encrypted[i])
-		bc.Message(macResult, macs[i], nil)
-		if subtle.ConstantTimeAllEq(macResult, 0) != 1 {
+		if !VerifyMAC(bc, macs[i]) {
 			t.Log("Invalid MAC")
 			t.FailNow()
 		}
@@ -391,34 +815,456 @@ func MultipleMessages(t *testing.T,
 
 func StreamInv(t *testing.T,
 	newCipher func([]byte, ...interface{}) abstract.Cipher) {
+	StreamInvSizes(t, newCipher, []int{256})
+}
+
+// Tests that a Cipher encrypts plaintexts of each of the given sizes
+// into ciphertexts of exactly the same length, with the MAC kept separate:
+// a ciphertext of the plaintext's length must decrypt correctly,
+// and producing more output must not change the first len(plaintext) bytes,
+// so no padding or length-dependent framing is involved.
+func LengthPreservationTest(t *testing.T,
+	newCipher func([]byte, ...interface{}) abstract.Cipher,
+	sizes []int) {
 	c := newCipher(nil)
 	key := make([]byte, c.KeySize())
 	rand.Read(key)
-	m1 := make([]byte, 256)
-	m2 := make([]byte, 256)
-	d1 := make([]byte, 256)
-	d2 := make([]byte, 256)
-	rand.Read(m1)
-	rand.Read(m2)
-	c = newCipher(key)
-	c.Partial(d1, m1, key)
-	c = newCipher(key)
-	c.Partial(d2, m2, nil)
-	for i := 0; i < 256; i++ {
-		if d1[i]^d2[i] != m1[i]^m2[i] {
-			t.Log("Xor invariant fails")
+	for _, size := range sizes {
+		text := make([]byte, size)
+		rand.Read(text)
+
+		crypt := make([]byte, size)
+		newCipher(key).Message(crypt, text, crypt)
+		decrypted := make([]byte, size)
+		newCipher(key).Message(decrypted, crypt, crypt)
+		if !bytes.Equal(text, decrypted) {
+			t.Log("Same-length ciphertext didn't decrypt, size", size)
+			t.FailNow()
+		}
+
+		exact := make([]byte, size)
+		newCipher(key).Message(exact, text, nil)
+		longer := make([]byte, size+17)
+		newCipher(key).Message(longer, text, nil)
+		if !bytes.Equal(exact, longer[:size]) {
+			t.Log("Ciphertext depends on output length, size", size)
 			t.FailNow()
 		}
 	}
 }
 
+// Tests the XOR invariant checked by StreamInv across several message sizes,
+// which should include odd sizes and sizes spanning internal block
+// boundaries, where a keystream bug might not show at a round size.
+func StreamInvSizes(t *testing.T,
+	newCipher func([]byte, ...interface{}) abstract.Cipher,
+	sizes []int) {
+	c := newCipher(nil)
+	key := make([]byte, c.KeySize())
+	rand.Read(key)
+	for _, size := range sizes {
+		m1 := make([]byte, size)
+		m2 := make([]byte, size)
+		d1 := make([]byte, size)
+		d2 := make([]byte, size)
+		rand.Read(m1)
+		rand.Read(m2)
+		c = newCipher(key)
+		c.Partial(d1, m1, key)
+		c = newCipher(key)
+		c.Partial(d2, m2, nil)
+		for i := 0; i < size; i++ {
+			if d1[i]^d2[i] != m1[i]^m2[i] {
+				t.Log("Xor invariant fails with size", size)
+				t.FailNow()
+			}
+		}
+	}
+}
+
+// Tests the documented semantics of the third (key) argument of Partial:
+// 1) A nil key XORs src with the keystream Partial(dst, nil, nil) yields
+// 2) A nil key is equivalent to an all-zero key of the same length
+// 3) Non-zero key material affects output once the message is complete
+func PartialThirdArgTest(t *testing.T,
+	newCipher func([]byte, ...interface{}) abstract.Cipher) {
+	c := newCipher(nil)
+	key := make([]byte, c.KeySize())
+	rand.Read(key)
+	m := make([]byte, 256)
+	rand.Read(m)
+
+	ks := make([]byte, len(m))
+	newCipher(key).Partial(ks, nil, nil)
+	d := make([]byte, len(m))
+	c1 := newCipher(key).Partial(d, m, nil)
+	for i := range d {
+		if d[i] != m[i]^ks[i] {
+			t.Log("Partial with nil key is not keystream XOR")
+			t.FailNow()
+		}
+	}
+
+	d0 := make([]byte, len(m))
+	c0 := newCipher(key).Partial(d0, m, make([]byte, len(m)))
+	if !bytes.Equal(d, d0) {
+		t.Log("Partial with nil key differs from all-zero key")
+		t.FailNow()
+	}
+
+	dk := make([]byte, len(m))
+	ck := newCipher(key).Partial(dk, m, m)
+
+	out1 := make([]byte, c.HashSize())
+	out0 := make([]byte, c.HashSize())
+	outk := make([]byte, c.HashSize())
+	c1.Message(nil, nil, nil).Partial(out1, nil, nil)
+	c0.Message(nil, nil, nil).Partial(out0, nil, nil)
+	ck.Message(nil, nil, nil).Partial(outk, nil, nil)
+	if !bytes.Equal(out1, out0) {
+		t.Log("Nil key and all-zero key leave different states")
+		t.FailNow()
+	}
+	if bytes.Equal(out1, outk) {
+		t.Log("Key material absorbed by Partial has no effect")
+		t.FailNow()
+	}
+}
+
+// Tests the documented handling of keys whose length differs from KeySize():
+// key material may be of any length, so shorter and longer keys
+// must be accepted and must round-trip,
+// every key byte must affect the output (no silent truncation),
+// and a short key must not be equivalent to its zero-padded form.
+func KeySizeToleranceTest(t *testing.T,
+	newCipher func([]byte, ...interface{}) abstract.Cipher) {
+	keysize := newCipher(nil).KeySize()
+	text := []byte("Hello, World")
+	lens := []int{1, keysize - 1, keysize, keysize + 1, 4 * keysize}
+	for _, l := range lens {
+		if l <= 0 {
+			continue
+		}
+		key := make([]byte, l)
+		rand.Read(key)
+		crypt := make([]byte, len(text))
+		decrypted := make([]byte, len(text))
+		newCipher(key).Message(crypt, text, nil)
+		newCipher(key).Message(decrypted, crypt, nil)
+		if !bytes.Equal(text, decrypted) {
+			t.Log("Encryption / Decryption failed with key length", l)
+			t.FailNow()
+		}
+
+		key[l-1] ^= 1
+		crypt2 := make([]byte, len(text))
+		newCipher(key).Message(crypt2, text, nil)
+		if bytes.Equal(crypt, crypt2) {
+			t.Log("Last key byte ignored with key length", l)
+			t.FailNow()
+		}
+		key[l-1] ^= 1
+
+		if l < keysize {
+			padded := make([]byte, keysize)
+			copy(padded, key)
+			newCipher(padded).Message(crypt2, text, nil)
+			if bytes.Equal(crypt, crypt2) {
+				t.Log("Short key silently zero-padded, length", l)
+				t.FailNow()
+			}
+		}
+	}
+}
+
+// Tests that a ciphertext and MAC produced under one key
+// fail to verify under any of several readily-available other keys:
+// random keys, the key with a single bit flipped,
+// the key truncated or zero-extended by one byte, and the empty key.
+// This doesn't prove the Cipher is key-committing,
+// which would require showing no second key can be found at all,
+// but catches constructions in which a related key trivially verifies.
+func KeyCommitmentTest(t *testing.T,
+	newCipher func([]byte, ...interface{}) abstract.Cipher) {
+	keysize := newCipher(nil).KeySize()
+	text := []byte("Hello, World")
+
+	key := make([]byte, keysize)
+	rand.Read(key)
+	c := newCipher(key)
+	crypt := make([]byte, len(text))
+	c.Message(crypt, text, crypt)
+	mac := make([]byte, c.HashSize())
+	c.Message(mac, nil, nil)
+
+	var others [][]byte
+	for i := 0; i < 10; i++ {
+		other := make([]byte, keysize)
+		rand.Read(other)
+		others = append(others, other)
+	}
+	flipped := append([]byte{}, key...)
+	flipped[0] ^= 1
+	others = append(others, flipped, key[:keysize-1],
+		append(append([]byte{}, key...), 0), []byte{})
+
+	decrypted := make([]byte, len(text))
+	verifies := func(k []byte) bool {
+		c := newCipher(k)
+		c.Message(decrypted, crypt, crypt)
+		return VerifyMAC(c, mac)
+	}
+	if !verifies(key) {
+		t.Log("Ciphertext failed to verify under its own key")
+		t.FailNow()
+	}
+	for i, other := range others {
+		if verifies(other) {
+			t.Log("Ciphertext verified under other key", i)
+			t.FailNow()
+		}
+	}
+}
+
+// Environment variable that enables MACTimingTest when non-empty.
+const TimingTestEnv = "CRYPTO_TIMING_TESTS"
+
+// Tests on a best-effort basis that the MAC verification routine verify,
+// e.g., VerifyMAC or an implementation's own, takes time independent
+// of where a received MAC differs from the correct one,
+// by timing many interleaved verifications of the correct MAC
+// and of MACs differing in the first or the last byte,
+// and failing if the median times differ by more than maxSkew,
+// a fraction of the smallest median, e.g., 0.5.
+// Only verify is timed, so this catches a short-circuiting comparison
+// in verify but not in code the test doesn't call.
+// Timing measurements are noisy and slow, so this test is skipped
+// unless the environment variable named by TimingTestEnv is set.
+func MACTimingTest(t *testing.T,
+	newCipher func([]byte, ...interface{}) abstract.Cipher,
+	verify func(c abstract.Cipher, received []byte) bool,
+	maxSkew float64) {
+	if os.Getenv(TimingTestEnv) == "" {
+		t.Skip("skipping MAC timing test; set " + TimingTestEnv +
+			" to enable it")
+	}
+	c := newCipher(nil)
+	key := make([]byte, c.KeySize())
+	rand.Read(key)
+	text := make([]byte, 64)
+	rand.Read(text)
+
+	c = newCipher(key)
+	crypt := make([]byte, len(text))
+	c.Message(crypt, text, crypt)
+	good := make([]byte, c.HashSize())
+	c.Message(good, nil, nil)
+	first := append([]byte{}, good...)
+	first[0] ^= 1
+	last := append([]byte{}, good...)
+	last[len(last)-1] ^= 1
+	macs := [][]byte{good, first, last}
+
+	const iters = 2000
+	times := make([][]float64, len(macs))
+	decrypted := make([]byte, len(text))
+	for i := 0; i < iters; i++ {
+		for j, mac := range macs {
+			c := newCipher(key)
+			c.Message(decrypted, crypt, crypt)
+			start := time.Now()
+			verify(c, mac)
+			times[j] = append(times[j], float64(time.Since(start)))
+		}
+	}
+
+	medians := make([]float64, len(macs))
+	for j := range times {
+		sort.Float64s(times[j])
+		medians[j] = times[j][iters/2]
+	}
+	min, max := medians[0], medians[0]
+	for _, m := range medians {
+		min = math.Min(min, m)
+		max = math.Max(max, m)
+	}
+	if max-min > maxSkew*min {
+		t.Log("MAC verification timing varies: medians (ns)", medians)
+		t.FailNow()
+	}
+}
+
+// Tests that a Cipher whose state is serializable
+// via encoding.BinaryMarshaler and encoding.BinaryUnmarshaler
+// can resume an interrupted stream:
+// encrypting half a stream, serializing the Cipher,
+// restoring the state into a fresh Cipher and encrypting the rest
+// must match encrypting the whole stream at once, MAC included.
+// Skips the test if the Cipher doesn't support serialization.
+func StateSerializationTest(t *testing.T,
+	newCipher func([]byte, ...interface{}) abstract.Cipher) {
+	c := newCipher(nil)
+	if _, ok := c.(encoding.BinaryMarshaler); !ok {
+		t.Skip("cipher state not serializable")
+	}
+	key := make([]byte, c.KeySize())
+	rand.Read(key)
+	text := make([]byte, 10000)
+	rand.Read(text)
+	half := len(text)/2 + 1
+
+	c = newCipher(key)
+	crypt := make([]byte, len(text))
+	c.Partial(crypt, text, crypt)
+	c.Message(nil, nil, nil)
+	mac := make([]byte, c.HashSize())
+	c.Message(mac, nil, nil)
+
+	c = newCipher(key)
+	resumed := make([]byte, len(text))
+	c.Partial(resumed[:half], text[:half], resumed[:half])
+	state, err := c.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		t.Log("Serializing cipher state failed:", err)
+		t.FailNow()
+	}
+	c = newCipher(abstract.NoKey)
+	err = c.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+	if err != nil {
+		t.Log("Restoring cipher state failed:", err)
+		t.FailNow()
+	}
+	c.Partial(resumed[half:], text[half:], resumed[half:])
+	c.Message(nil, nil, nil)
+	if !bytes.Equal(crypt, resumed) {
+		t.Log("Resumed encryption differs from one-shot encryption")
+		t.FailNow()
+	}
+	if !VerifyMAC(c, mac) {
+		t.Log("Resumed encryption produced a different MAC")
+		t.FailNow()
+	}
+}
+
 func BlockCipherTest(t *testing.T,
 	newCipher func([]byte, ...interface{}) abstract.Cipher) {
+	blockCipherTests(t, func() func([]byte,
+		...interface{}) abstract.Cipher {
+		return newCipher
+	})
+}
+
+// Runs the BlockCipherTest battery, giving each helper
+// the Cipher constructor that next() returns.
+func blockCipherTests(t *testing.T,
+	next func() func([]byte, ...interface{}) abstract.Cipher) {
 	n := 5
 	bitdiff := .35
 	randdiff := 0.1
-	BCHelloWorldHelper(t, newCipher, n, bitdiff)
-	BCAuthenticatedEncryptionHelper(t, newCipher, n, bitdiff)
-	CipherPRNG(t, newCipher, randdiff)
-	StreamInv(t, newCipher)
+	BCHelloWorldHelper(t, next(), n, bitdiff)
+	BCAuthenticatedEncryptionHelper(t, next(), n, bitdiff)
+	CipherPRNG(t, next(), randdiff)
+	StreamInv(t, next())
+	StreamInvSizes(t, next(), []int{1, 15, 16, 17, 135, 136, 137,
+		167, 168, 169, 255, 257, 1023, 1024, 1025, 4097})
+	LengthPreservationTest(t, next(), []int{0, 1, 15, 16, 17, 32,
+		136, 168, 1000})
+	PartialThirdArgTest(t, next())
+	KeySizeToleranceTest(t, next())
+	KeyCommitmentTest(t, next())
+}
+
+// Wrap a Cipher constructor so that it passes nonce
+// ahead of any options given to the wrapper.
+func WithNonce(newCipher func([]byte, ...interface{}) abstract.Cipher,
+	nonce interface{}) func([]byte, ...interface{}) abstract.Cipher {
+	return func(key []byte, options ...interface{}) abstract.Cipher {
+		all := append([]interface{}{nonce}, options...)
+		return newCipher(key, all...)
+	}
+}
+
+// Runs the BlockCipherTest battery and NonceTest on a Cipher
+// that takes a nonce among its options, generated by newNonce.
+// Each helper in the battery gets a fresh nonce via WithNonce(),
+// shared by all the Cipher instances it constructs,
+// since its decryptions must use the nonce of its encryptions
+// and its key-sensitivity checks must vary only the key.
+func NonceBlockCipherTest(t *testing.T,
+	newCipher func([]byte, ...interface{}) abstract.Cipher,
+	newNonce func() interface{}) {
+	blockCipherTests(t, func() func([]byte,
+		...interface{}) abstract.Cipher {
+		return WithNonce(newCipher, newNonce())
+	})
+	NonceTest(t, newCipher, newNonce, .35)
+}
+
+// Runs the core encryption, decryption, and MAC tests on ciphers
+// constructed with the given options, e.g., a custom padding byte,
+// ahead of any options the tests themselves pass,
+// to check that the options don't break the Cipher contract.
+func OptionsTest(t *testing.T,
+	newCipher func([]byte, ...interface{}) abstract.Cipher,
+	opts []interface{}) {
+	withOpts := func(key []byte, options ...interface{}) abstract.Cipher {
+		all := append(append([]interface{}{}, opts...), options...)
+		return newCipher(key, all...)
+	}
+	messages := [][]byte{{}, {'a'}, []byte("Hello, World"),
+		make([]byte, 1<<10)}
+	LengthPreservationTest(t, withOpts, []int{0, 1, 16, 17, 1000})
+	PartialThirdArgTest(t, withOpts)
+	MultipleMessages(t, withOpts, messages)
+	SmallMessageTest(t, withOpts)
+	KeyCommitmentTest(t, withOpts)
+}
+
+// Tests a Cipher that takes a nonce among its options,
+// generated as an option value by newNonce, e.g., a random byte slice
+// of the implementation's own nonce type:
+// 1) The same key and plaintext under distinct nonces
+// yield sufficiently different ciphertexts
+// 2) Decryption under the encryption nonce verifies and round-trips
+// 3) Decryption under a different nonce makes the MAC check fail
+// The other helpers pass no options; to run them on a Cipher
+// that requires a nonce, use NonceBlockCipherTest() or WithNonce().
+func NonceTest(t *testing.T,
+	newCipher func([]byte, ...interface{}) abstract.Cipher,
+	newNonce func() interface{}, bitdiff float64) {
+	keysize := newCipher(nil, newNonce()).KeySize()
+	key := make([]byte, keysize)
+	rand.Read(key)
+	text := make([]byte, 64) // long enough for a reliable BitDiff
+	rand.Read(text)
+
+	nonces := []interface{}{newNonce(), newNonce()}
+	crypts := make([][]byte, len(nonces))
+	macs := make([][]byte, len(nonces))
+	for i, nonce := range nonces {
+		c := newCipher(key, nonce)
+		crypts[i] = make([]byte, len(text))
+		c.Message(crypts[i], text, crypts[i])
+		macs[i] = make([]byte, c.HashSize())
+		c.Message(macs[i], nil, nil)
+	}
+	if res := BitDiff(crypts[0], crypts[1]); res < bitdiff {
+		t.Log("Encryptions under distinct nonces not sufficiently "+
+			"different", res)
+		t.FailNow()
+	}
+
+	decrypted := make([]byte, len(text))
+	c := newCipher(key, nonces[0])
+	c.Message(decrypted, crypts[0], crypts[0])
+	if !bytes.Equal(text, decrypted) || !VerifyMAC(c, macs[0]) {
+		t.Log("Decryption under the encryption nonce failed")
+		t.FailNow()
+	}
+	c = newCipher(key, nonces[1])
+	c.Message(decrypted, crypts[0], crypts[0])
+	if VerifyMAC(c, macs[0]) {
+		t.Log("MAC Check passed under a different nonce")
+		t.FailNow()
+	}
 }
@@ -0,0 +1,254 @@
+package test
+
+import (
+	"bytes"
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/cipher"
+	"github.com/dedis/crypto/cipher/sha3"
+	"github.com/dedis/crypto/random"
+	"testing"
+)
+
+func TestBitDiff(t *testing.T) {
+	cases := []struct {
+		name string
+		a, b []byte
+		diff float64
+	}{
+		{"identical", []byte{0x12, 0x34, 0x56}, []byte{0x12, 0x34, 0x56}, 0},
+		{"inverted", []byte{0x00, 0xff, 0x5a}, []byte{0xff, 0x00, 0xa5}, 1},
+		{"length mismatch", []byte{0x00, 0x00}, []byte{0x00}, -1},
+		{"one bit", []byte{0x00, 0x00, 0x00, 0x00},
+			[]byte{0x00, 0x00, 0x10, 0x00}, 1.0 / 32},
+	}
+	for _, c := range cases {
+		if d := BitDiff(c.a, c.b); d != c.diff {
+			t.Errorf("%s: BitDiff = %v, want %v", c.name, d, c.diff)
+		}
+	}
+}
+
+func TestBitDiffThreshold(t *testing.T) {
+	// The smallest message the BitDiff checks see is "Hello, World".
+	const nbytes = 12
+	rate := BitDiffFalseRate(nbytes, 0.35)
+	if rate <= 0.001 {
+		t.Fatalf("expected 0.35 to fail too often at %d bytes, rate %v",
+			nbytes, rate)
+	}
+
+	// Random pairs fail the fixed threshold at about the computed rate.
+	const trials = 100000
+	fails := 0
+	a := make([]byte, nbytes)
+	b := make([]byte, nbytes)
+	for i := 0; i < trials; i++ {
+		random.Stream.XORKeyStream(a, a)
+		random.Stream.XORKeyStream(b, b)
+		if BitDiff(a, b) < 0.35 {
+			fails++
+		}
+	}
+	want := rate * trials
+	if d := float64(fails) - want; d*d > 25*want {
+		t.Fatalf("%d of %d random pairs failed, expected about %v",
+			fails, trials, want)
+	}
+
+	// The size-dependent threshold fails rarely enough.
+	thr := BitDiffThreshold(nbytes, 0.35, 0.001)
+	if thr >= 0.35 {
+		t.Fatalf("threshold %v not lowered for short messages", thr)
+	}
+	if r := BitDiffFalseRate(nbytes, thr); r > 0.001 {
+		t.Fatalf("threshold %v still fails at rate %v", thr, r)
+	}
+	if r := BitDiffFalseRate(nbytes, thr+1.0/(8*nbytes)); r <= 0.001 {
+		t.Fatalf("threshold %v lower than necessary", thr)
+	}
+
+	// Long messages keep the requested threshold.
+	if thr := BitDiffThreshold(1<<10, 0.35, 1e-6); thr != 0.35 {
+		t.Fatalf("threshold %v lowered for 1KB messages", thr)
+	}
+}
+
+func TestByteDiff(t *testing.T) {
+	cases := []struct {
+		name string
+		a, b []byte
+		diff float64
+	}{
+		{"identical", []byte{0x12, 0x34, 0x56}, []byte{0x12, 0x34, 0x56}, 0},
+		{"all differ", []byte{0x00, 0xff, 0x5a}, []byte{0x01, 0x00, 0xa5}, 1},
+		{"length mismatch", []byte{0x00, 0x00}, []byte{0x00}, -1},
+		{"one bit", []byte{0x00, 0x00, 0x00, 0x00},
+			[]byte{0x00, 0x00, 0x10, 0x00}, 1.0 / 4},
+	}
+	for _, c := range cases {
+		if d := ByteDiff(c.a, c.b); d != c.diff {
+			t.Errorf("%s: ByteDiff = %v, want %v", c.name, d, c.diff)
+		}
+	}
+}
+
+func TestOnceKey(t *testing.T) {
+	newCipher := OnceKey(ReferenceCipher)
+	newCipher(nil)
+	newCipher(nil)
+	newCipher([]byte("key one"))
+	newCipher([]byte("key two"))
+	defer func() {
+		if recover() == nil {
+			t.Fatal("OnceKey didn't catch a reused key")
+		}
+	}()
+	newCipher([]byte("key one"))
+}
+
+func FuzzCipherRoundTrip(f *testing.F) {
+	f.Add([]byte("key"), []byte("Hello, World"))
+	f.Add([]byte{}, []byte{})
+	f.Add(make([]byte, 16), make([]byte, 1))
+	f.Add(bytes.Repeat([]byte{0xff}, 33), make([]byte, 1025))
+	f.Fuzz(func(t *testing.T, key, text []byte) {
+		if key == nil {
+			key = []byte{} // nil would request a random key
+		}
+		c := ReferenceCipher(key)
+		crypt := make([]byte, len(text))
+		c.Message(crypt, text, crypt)
+		mac := make([]byte, c.HashSize())
+		c.Message(mac, nil, nil)
+
+		verify := func(crypt []byte) bool {
+			c := ReferenceCipher(key)
+			decrypted := make([]byte, len(crypt))
+			c.Message(decrypted, crypt, crypt)
+			return VerifyMAC(c, mac) && bytes.Equal(decrypted, text)
+		}
+		if !verify(crypt) {
+			t.Fatal("round trip failed")
+		}
+		if len(crypt) > 0 {
+			crypt[len(crypt)/2] ^= 0x10
+			if verify(crypt) {
+				t.Fatal("flipped ciphertext bit went undetected")
+			}
+		}
+	})
+}
+
+func TestVerifyMAC(t *testing.T) {
+	key := []byte("key")
+	c := ReferenceCipher(key)
+	mac := make([]byte, c.HashSize())
+	c.Message(nil, nil, []byte("message"))
+	c.Message(mac, nil, nil)
+	orig := append([]byte{}, mac...)
+
+	c = ReferenceCipher(key)
+	c.Message(nil, nil, []byte("message"))
+	if !VerifyMAC(c, mac) {
+		t.Fatal("correct MAC failed to verify")
+	}
+	if !bytes.Equal(mac, orig) {
+		t.Fatal("VerifyMAC modified the received MAC")
+	}
+
+	mac[len(mac)-1] ^= 1
+	c = ReferenceCipher(key)
+	c.Message(nil, nil, []byte("message"))
+	if VerifyMAC(c, mac) {
+		t.Fatal("corrupted MAC verified")
+	}
+}
+
+func TestStateSerialization(t *testing.T) {
+	StateSerializationTest(t, sha3.NewShakeCipher128)
+}
+
+func TestMessageAlias(t *testing.T) {
+	MessageAliasTest(t, ReferenceCipher)
+	MessageAliasTest(t, sha3.NewShakeCipher128)
+}
+
+func TestMACCoverage(t *testing.T) {
+	text := make([]byte, 400) // spans several SHAKE128 blocks
+	for i := range text {
+		text[i] = byte(i)
+	}
+	MACCoverageTest(t, ReferenceCipher, text)
+	MACCoverageTest(t, sha3.NewShakeCipher128, text)
+}
+
+func TestPartialADMAC(t *testing.T) {
+	text := make([]byte, 400) // spans several SHAKE128 blocks
+	for i := range text {
+		text[i] = byte(i)
+	}
+	for _, adlen := range []int{0, 1, 8, 17, 200} {
+		ad := text[:adlen]
+		PartialADMACTest(t, ReferenceCipher, ad, text)
+		PartialADMACTest(t, sha3.NewShakeCipher128, ad, text)
+		PartialADMACTest(t, sha3.NewShakeCipher128, ad, text[:5])
+	}
+}
+
+func TestInPlaceDecrypt(t *testing.T) {
+	for _, size := range []int{1, 16, 200, 1000} {
+		text := random.Bytes(size, random.Stream)
+		InPlaceDecryptTest(t, ReferenceCipher, text)
+		InPlaceDecryptTest(t, sha3.NewShakeCipher128, text)
+	}
+}
+
+// Nonce option for testNonceCipher.
+type testNonce []byte
+
+// Reference cipher requiring a nonce, which it appends to the key,
+// unless the key is nil and thus to be chosen at random.
+func testNonceCipher(key []byte, options ...interface{}) abstract.Cipher {
+	var nonce testNonce
+	var rest []interface{}
+	for _, opt := range options {
+		if n, ok := opt.(testNonce); ok {
+			nonce = n
+		} else {
+			rest = append(rest, opt)
+		}
+	}
+	if nonce == nil {
+		panic("testNonceCipher: no nonce")
+	}
+	if key != nil {
+		key = append(append([]byte{}, key...), nonce...)
+	}
+	return ReferenceCipher(key, rest...)
+}
+
+func TestNonce(t *testing.T) {
+	NonceBlockCipherTest(t, testNonceCipher, func() interface{} {
+		return testNonce(random.Bytes(16, random.Stream))
+	})
+}
+
+func TestOptions(t *testing.T) {
+	OptionsTest(t, sha3.NewShakeCipher128,
+		[]interface{}{cipher.Padding(0x06)})
+}
+
+func BenchmarkCiphers128(b *testing.B) {
+	BenchmarkCiphers(b, map[string]func([]byte, ...interface{}) abstract.Cipher{
+		"AES128-SHA256": ReferenceCipher,
+		"SHAKE128":      sha3.NewShakeCipher128,
+	})
+}
+
+func BenchmarkReferenceCipherSetup(b *testing.B) {
+	CipherSetupBench(b, 16, ReferenceCipher)
+}
+
+func BenchmarkShakeCipher128Setup(b *testing.B) {
+	CipherSetupBench(b, 16, sha3.NewShakeCipher128)
+}
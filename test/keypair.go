@@ -0,0 +1,25 @@
+package test
+
+import (
+	"crypto/cipher"
+	"github.com/dedis/crypto/abstract"
+)
+
+// Generate a keypair for a ciphersuite, for tests and examples:
+// a random private Secret and the corresponding public Point.
+// If the suite's Points support the abstract.Hiding interface,
+// keeps picking until the public Point is hiding-encodable,
+// since for some encodings, e.g., Elligator, only some points are.
+func GenKeypair(suite abstract.Suite, rand cipher.Stream) (abstract.Secret,
+	abstract.Point) {
+	pri := suite.Secret()
+	pub := suite.Point()
+	for {
+		pri.Pick(rand)
+		pub.Mul(nil, pri)
+		h, ok := pub.(abstract.Hiding)
+		if !ok || h.HideEncode(rand) != nil {
+			return pri, pub
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package test
+
+import (
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/edwards"
+	"github.com/dedis/crypto/random"
+	"testing"
+)
+
+func TestGenKeypair(t *testing.T) {
+	for _, suite := range []abstract.Suite{
+		MockSuite("Mock", 32),
+		edwards.NewAES128SHA256Ed25519(true),
+	} {
+		for i := 0; i < 10; i++ {
+			pri, pub := GenKeypair(suite, random.Stream)
+			if !pub.Equal(suite.Point().Mul(nil, pri)) {
+				t.Fatalf("%s: public key doesn't match private", suite)
+			}
+			if h, ok := pub.(abstract.Hiding); ok &&
+				h.HideEncode(random.Stream) == nil {
+				t.Fatalf("%s: public key not hiding-encodable", suite)
+			}
+		}
+	}
+}
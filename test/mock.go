@@ -0,0 +1,262 @@
+package test
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/cipher/sha3"
+	"github.com/dedis/crypto/group"
+	"github.com/dedis/crypto/random"
+	"hash"
+	"io"
+	"math/big"
+)
+
+// Modulus of the mock group: the Mersenne prime 2^61-1.
+var mockModulus = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 61),
+	big.NewInt(1))
+
+const mockLen = 8 // encoded length of mock Secrets and Points
+
+// Encode a value modulo mockModulus into a fixed-length big-endian slice.
+func mockBytes(v *big.Int) []byte {
+	buf := make([]byte, mockLen)
+	binary.BigEndian.PutUint64(buf, v.Uint64())
+	return buf
+}
+
+// Decode a fixed-length big-endian slice into a value modulo mockModulus.
+func mockSetBytes(v *big.Int, buf []byte) error {
+	if len(buf) != mockLen {
+		return errors.New("mock: wrong size buffer")
+	}
+	v.SetUint64(binary.BigEndian.Uint64(buf))
+	if v.Cmp(mockModulus) >= 0 {
+		return errors.New("mock: value out of range")
+	}
+	return nil
+}
+
+// Secret in the mock group: an integer modulo mockModulus.
+type mockSecret struct {
+	v big.Int
+}
+
+func (s *mockSecret) String() string { return s.v.String() }
+
+func (s *mockSecret) MarshalSize() int { return mockLen }
+
+func (s *mockSecret) MarshalBinary() ([]byte, error) {
+	return mockBytes(&s.v), nil
+}
+
+func (s *mockSecret) UnmarshalBinary(buf []byte) error {
+	return mockSetBytes(&s.v, buf)
+}
+
+func (s *mockSecret) MarshalTo(w io.Writer) (int, error) {
+	return group.SecretMarshalTo(s, w)
+}
+
+func (s *mockSecret) UnmarshalFrom(r io.Reader) (int, error) {
+	return group.SecretUnmarshalFrom(s, r)
+}
+
+func (s *mockSecret) Equal(s2 abstract.Secret) bool {
+	return s.v.Cmp(&s2.(*mockSecret).v) == 0
+}
+
+func (s *mockSecret) Set(a abstract.Secret) abstract.Secret {
+	s.v.Set(&a.(*mockSecret).v)
+	return s
+}
+
+func (s *mockSecret) SetInt64(v int64) abstract.Secret {
+	s.v.Mod(big.NewInt(v), mockModulus)
+	return s
+}
+
+func (s *mockSecret) Zero() abstract.Secret { return s.SetInt64(0) }
+
+func (s *mockSecret) One() abstract.Secret { return s.SetInt64(1) }
+
+func (s *mockSecret) Add(a, b abstract.Secret) abstract.Secret {
+	s.v.Add(&a.(*mockSecret).v, &b.(*mockSecret).v)
+	s.v.Mod(&s.v, mockModulus)
+	return s
+}
+
+func (s *mockSecret) Sub(a, b abstract.Secret) abstract.Secret {
+	s.v.Sub(&a.(*mockSecret).v, &b.(*mockSecret).v)
+	s.v.Mod(&s.v, mockModulus)
+	return s
+}
+
+func (s *mockSecret) Neg(a abstract.Secret) abstract.Secret {
+	s.v.Neg(&a.(*mockSecret).v)
+	s.v.Mod(&s.v, mockModulus)
+	return s
+}
+
+func (s *mockSecret) Mul(a, b abstract.Secret) abstract.Secret {
+	s.v.Mul(&a.(*mockSecret).v, &b.(*mockSecret).v)
+	s.v.Mod(&s.v, mockModulus)
+	return s
+}
+
+func (s *mockSecret) Div(a, b abstract.Secret) abstract.Secret {
+	var inv mockSecret
+	inv.Inv(b)
+	return s.Mul(a, &inv)
+}
+
+func (s *mockSecret) Inv(a abstract.Secret) abstract.Secret {
+	s.v.ModInverse(&a.(*mockSecret).v, mockModulus)
+	return s
+}
+
+func (s *mockSecret) Pick(rand cipher.Stream) abstract.Secret {
+	s.v.Set(random.Int(mockModulus, rand))
+	return s
+}
+
+// Point in the mock group: also an integer modulo mockModulus,
+// with the group operation being addition and the base point being 1.
+// This group offers no security whatsoever,
+// but satisfies the homomorphisms Diffie-Hellman relies on.
+type mockPoint struct {
+	v       big.Int
+	hidelen int
+}
+
+func (p *mockPoint) String() string { return p.v.String() }
+
+func (p *mockPoint) MarshalSize() int { return mockLen }
+
+func (p *mockPoint) MarshalBinary() ([]byte, error) {
+	return mockBytes(&p.v), nil
+}
+
+func (p *mockPoint) UnmarshalBinary(buf []byte) error {
+	return mockSetBytes(&p.v, buf)
+}
+
+func (p *mockPoint) MarshalTo(w io.Writer) (int, error) {
+	return group.PointMarshalTo(p, w)
+}
+
+func (p *mockPoint) UnmarshalFrom(r io.Reader) (int, error) {
+	return group.PointUnmarshalFrom(p, r)
+}
+
+func (p *mockPoint) Equal(p2 abstract.Point) bool {
+	return p.v.Cmp(&p2.(*mockPoint).v) == 0
+}
+
+func (p *mockPoint) Null() abstract.Point {
+	p.v.SetInt64(0)
+	return p
+}
+
+func (p *mockPoint) Base() abstract.Point {
+	p.v.SetInt64(1)
+	return p
+}
+
+func (p *mockPoint) Pick(data []byte, rand cipher.Stream) (abstract.Point,
+	[]byte) {
+	p.v.Set(random.Int(mockModulus, rand))
+	return p, data
+}
+
+func (p *mockPoint) PickLen() int { return 0 }
+
+func (p *mockPoint) Data() ([]byte, error) {
+	return []byte{}, nil // mock points embed no data
+}
+
+func (p *mockPoint) Add(a, b abstract.Point) abstract.Point {
+	p.v.Add(&a.(*mockPoint).v, &b.(*mockPoint).v)
+	p.v.Mod(&p.v, mockModulus)
+	return p
+}
+
+func (p *mockPoint) Sub(a, b abstract.Point) abstract.Point {
+	p.v.Sub(&a.(*mockPoint).v, &b.(*mockPoint).v)
+	p.v.Mod(&p.v, mockModulus)
+	return p
+}
+
+func (p *mockPoint) Neg(a abstract.Point) abstract.Point {
+	p.v.Neg(&a.(*mockPoint).v)
+	p.v.Mod(&p.v, mockModulus)
+	return p
+}
+
+func (p *mockPoint) Mul(b abstract.Point, s abstract.Secret) abstract.Point {
+	if b == nil {
+		p.v.Set(&s.(*mockSecret).v)
+		return p
+	}
+	p.v.Mul(&b.(*mockPoint).v, &s.(*mockSecret).v)
+	p.v.Mod(&p.v, mockModulus)
+	return p
+}
+
+// Hiding-encode the point as its 8-byte encoding
+// followed by random padding out to the configured length.
+// The encoding is not actually uniform.
+func (p *mockPoint) HideLen() int { return p.hidelen }
+
+func (p *mockPoint) HideEncode(rand cipher.Stream) []byte {
+	buf := random.Bytes(p.hidelen, rand)
+	copy(buf, mockBytes(&p.v))
+	return buf
+}
+
+func (p *mockPoint) HideDecode(buf []byte) {
+	p.v.SetUint64(binary.BigEndian.Uint64(buf))
+	p.v.Mod(&p.v, mockModulus)
+}
+
+// Mock ciphersuite with trivially-computed Secrets and Points.
+type mockSuite struct {
+	name    string
+	hidelen int
+}
+
+func (s *mockSuite) String() string { return s.name }
+
+func (s *mockSuite) Cipher(key []byte, options ...interface{}) abstract.Cipher {
+	return sha3.NewShakeCipher128(key, options...)
+}
+
+func (s *mockSuite) Hash() hash.Hash { return sha256.New() }
+
+func (s *mockSuite) SecretLen() int { return mockLen }
+
+func (s *mockSuite) Secret() abstract.Secret { return &mockSecret{} }
+
+func (s *mockSuite) PointLen() int { return mockLen }
+
+func (s *mockSuite) Point() abstract.Point {
+	return &mockPoint{hidelen: s.hidelen}
+}
+
+func (s *mockSuite) PrimeOrder() bool { return true }
+
+// Create a mock ciphersuite for fast testing of code
+// that needs a Suite but not the security of a real one,
+// such as header layout and placement logic.
+// The suite's Points support the abstract.Hiding interface
+// with a hiding-encoded length of hideLen bytes, which must be at least 8.
+// Its group arithmetic is trivial and provides no security,
+// though it satisfies the homomorphisms Diffie-Hellman relies on.
+func MockSuite(name string, hideLen int) abstract.Suite {
+	if hideLen < mockLen {
+		panic("mock suite hiding length too short")
+	}
+	return &mockSuite{name, hideLen}
+}
@@ -0,0 +1,9 @@
+package test
+
+import (
+	"testing"
+)
+
+func TestMockSuite(t *testing.T) {
+	TestSuite(MockSuite("Mock", 32))
+}
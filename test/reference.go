@@ -0,0 +1,19 @@
+package test
+
+import (
+	"crypto/aes"
+	"crypto/sha256"
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/cipher"
+)
+
+// ReferenceCipher creates a reference abstract.Cipher
+// built from the standard library's AES-128 block cipher and SHA2-256 hash,
+// for exercising the Cipher test helpers in this package.
+// Its construction matches cipher/aes.NewCipher128,
+// which this package cannot import since that package's tests import this one.
+// It also serves as an example of building a Cipher via cipher.FromBlock.
+func ReferenceCipher(key []byte, options ...interface{}) abstract.Cipher {
+	return cipher.FromBlock(aes.NewCipher, sha256.New,
+		aes.BlockSize, 128/8, 256/8, key, options...)
+}
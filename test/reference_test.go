@@ -0,0 +1,13 @@
+package test
+
+import (
+	"testing"
+)
+
+func TestReferenceCipher(t *testing.T) {
+	BlockCipherTest(t, ReferenceCipher)
+}
+
+func TestReferenceMACTiming(t *testing.T) {
+	MACTimingTest(t, ReferenceCipher, VerifyMAC, 0.5)
+}